@@ -0,0 +1,249 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// dbWriter writes rows of parsed logs inside a transaction.
+//
+// With a flushSize > 1 rows are buffered per table and written with
+// COPY once a table has flushSize rows or on flush(). Otherwise every row
+// is written with its own INSERT.
+//
+// Rows of logs that are already in the table are skipped, so a range can
+// be ingested again safely: COPY cannot skip conflicting rows, it writes
+// into a temporary staging table that is then inserted with ON CONFLICT
+// DO NOTHING.
+//
+// Reads through the dbWriter flush all buffered rows first, so that they
+// always see the rows inserted before them.
+type dbWriter struct {
+	ctx context.Context
+	tx pgx.Tx
+	flushSize int
+
+	bufs map[string]*rowBuffer
+	tables []string
+	// latest Sync of each pair, see pairstate.go
+	pairStates map[uint64]*pairStateRow
+}
+
+type rowBuffer struct {
+	cols []string
+	rows [][]interface{}
+}
+
+func newDBWriter(ctx context.Context, tx pgx.Tx, flushSize int) *dbWriter {
+	return &dbWriter{
+		ctx: ctx,
+		tx: tx,
+		flushSize: flushSize,
+		bufs: make(map[string]*rowBuffer),
+		pairStates: make(map[uint64]*pairStateRow),
+	}
+}
+
+func (w *dbWriter) insert(table string, cols []string, vals []interface{}) error {
+	if w.flushSize <= 1 {
+		q, err := insertSQL(table, cols)
+		if err != nil {
+			return err
+		}
+		return dbExec(w.ctx, w.tx, q, vals)
+	}
+
+	b, ok := w.bufs[table]
+	if !ok {
+		_, err := dbTable(table)
+		if err != nil {
+			return err
+		}
+		b = &rowBuffer{cols: cols}
+		w.bufs[table] = b
+		w.tables = append(w.tables, table)
+	}
+	b.rows = append(b.rows, vals)
+
+	if len(b.rows) >= w.flushSize {
+		return w.flushTable(table)
+	}
+	return nil
+}
+
+// flush writes all buffered rows, then the pair states.
+func (w *dbWriter) flush() error {
+	for _, t := range w.tables {
+		err := w.flushTable(t)
+		if err != nil {
+			return err
+		}
+	}
+	return w.flushPairStates()
+}
+
+func (w *dbWriter) flushTable(table string) error {
+	b := w.bufs[table]
+	if len(b.rows) == 0 {
+		return nil
+	}
+
+	t, err := dbTable(table)
+	if err != nil {
+		return err
+	}
+	stage := pgx.Identifier{"stage_" + table}.Sanitize()
+	_, err = w.tx.Exec(w.ctx, "CREATE TEMP TABLE IF NOT EXISTS "+stage+" (LIKE "+t+") ON COMMIT DROP")
+	if err != nil {
+		return dbError("tx.Exec", err)
+	}
+
+	n, err := w.tx.CopyFrom(w.ctx, pgx.Identifier{"stage_" + table}, b.cols, pgx.CopyFromRows(b.rows))
+	if err != nil {
+		log.Error("tx.CopyFrom", "err", err, "table", table, "rows", len(b.rows))
+		return dbError("tx.CopyFrom", err)
+	}
+	if int(n) != len(b.rows) {
+		log.Warn("tx.CopyFrom short", "table", table, "rows", len(b.rows), "copied", n)
+	}
+
+	cols := quoteColumns(b.cols)
+	tag, err := w.tx.Exec(w.ctx, "INSERT INTO "+t+" ("+cols+") SELECT "+cols+" FROM "+stage+" ON CONFLICT DO NOTHING")
+	if err != nil {
+		return dbError("tx.Exec", err)
+	}
+	if tag.RowsAffected() != n {
+		log.Debug("skipped rows already ingested", "table", table, "rows", n, "inserted", tag.RowsAffected())
+	}
+	_, err = w.tx.Exec(w.ctx, "TRUNCATE "+stage)
+	if err != nil {
+		return dbError("tx.Exec", err)
+	}
+	b.rows = b.rows[:0]
+	return nil
+}
+
+func (w *dbWriter) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+	return w.tx.Exec(ctx, sql, args...)
+}
+
+func (w *dbWriter) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+	return w.tx.Query(ctx, sql, args...)
+}
+
+// insertSQL returns an INSERT statement for table with all values bound
+// as parameters that skips rows already in the table.
+func insertSQL(table string, cols []string) (string, error) {
+	t, err := dbTable(table)
+	if err != nil {
+		return "", err
+	}
+	ps := make([]string, len(cols))
+	for i := range cols {
+		ps[i] = "$" + strconv.Itoa(i+1)
+	}
+	return "INSERT INTO " + t + " (" + quoteColumns(cols) + ") VALUES (" + strings.Join(ps, ", ") + ") ON CONFLICT DO NOTHING", nil
+}
+
+// quoteColumns returns the comma-separated list of cols. Columns are named
+// after ABI arguments and quoted, as COPY does.
+func quoteColumns(cols []string) string {
+	qs := make([]string, len(cols))
+	for i, c := range cols {
+		qs[i] = pgx.Identifier{c}.Sanitize()
+	}
+	return strings.Join(qs, ", ")
+}
+
+// BenchInsert compares the per-row INSERT path with the COPY path by
+// writing n synthetic Swap rows for each given flush size. Every run is
+// rolled back, nothing is left in the database.
+func BenchInsert(ctx context.Context, cfg *Config, n int, flushSizes []int) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dbConn, err := getDBConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Release()
+
+	for _, fs := range flushSizes {
+		tx, err := dbConn.Begin(ctx)
+		if err != nil {
+			return dbError("dbConn.Begin", err)
+		}
+
+		t0 := time.Now()
+		err = benchWrite(ctx, tx, fs, n)
+		t := time.Since(t0)
+
+		tx.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+
+		mode := "insert"
+		if fs > 1 {
+			mode = "copy"
+		}
+		log.Info("bench", "mode", mode, "flushSize", fs, "rows", n, "t", t, "rows/s", int(float64(n)/t.Seconds()))
+	}
+	return nil
+}
+
+var benchCols = []string{"pair_id", "block", "tx_hash", "log_index", "sender", "dest", "amount0in", "amount1in", "amount0out", "amount1out"}
+
+// benchWrite writes n synthetic Swap rows in tx with the given flush size.
+func benchWrite(ctx context.Context, tx pgx.Tx, flushSize, n int) error {
+	ether, zero := dbNumeric(big.NewInt(1e18)), dbNumeric(new(big.Int))
+	w := newDBWriter(ctx, tx, flushSize)
+	for i := 0; i < n; i++ {
+		row := []interface{}{
+			uint64(0), uint64(uniswapFactoryCreateBlock + i), "0x" + strings.Repeat("ab", 32), uint64(0),
+			uniswapFactoryAddr, uniswapFactoryAddr,
+			ether, zero, zero, dbNumeric(big.NewInt(int64(i))),
+		}
+		err := w.insert("us_pair_swap", benchCols, row)
+		if err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
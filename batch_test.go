@@ -0,0 +1,65 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkInsert compares the per-row INSERT path (flush size 1) with the
+// COPY path on the database given by KANOT_TEST_DB, one Swap row per
+// iteration. Rows are rolled back.
+func BenchmarkInsert(b *testing.B) {
+	cfg := testDBConfig(b)
+	ctx := context.Background()
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer release()
+
+	for _, fs := range []int{1, 100, 1000, 10000} {
+		mode := "insert"
+		if fs > 1 {
+			mode = "copy"
+		}
+		b.Run(mode+"-"+strconv.Itoa(fs), func(b *testing.B) {
+			dbConn, err := getDBConn(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dbConn.Release()
+			tx, err := dbConn.Begin(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tx.Rollback(ctx)
+
+			b.ResetTimer()
+			err = benchWrite(ctx, tx, fs, b.N)
+			b.StopTimer()
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Block headers.
+//
+// The header of every block with an ingested log is kept in the blocks
+// table, committed with the logs, so that events can be joined on their
+// block to get its timestamp. In low latency mode the blocks table also
+// holds every block of the last reorgMaxDepth, see reorg.go.
+
+// blockHeader is a header with the block hash reported by the node.
+// types.Header of the go-ethereum version in use lacks the fields added
+// since London, so its Hash is wrong for later blocks and is never used.
+type blockHeader struct {
+	*types.Header
+	hash common.Hash
+}
+
+// Hash returns the block hash reported by the node.
+func (h *blockHeader) Hash() common.Hash {
+	return h.hash
+}
+
+func (h *blockHeader) UnmarshalJSON(input []byte) error {
+	var dec struct {
+		Hash *common.Hash `json:"hash"`
+	}
+	err := json.Unmarshal(input, &dec)
+	if err != nil {
+		return err
+	}
+	if dec.Hash == nil {
+		return errors.New("missing required field 'hash' for blockHeader")
+	}
+	header := new(types.Header)
+	err = json.Unmarshal(input, header)
+	if err != nil {
+		return err
+	}
+	h.Header, h.hash = header, *dec.Hash
+	return nil
+}
+
+// getHeaders fetches the headers of blocks numbers in batch requests of
+// headerBatchSize.
+func getHeaders(ctx context.Context, rc *rpc.Client, numbers []uint64) (map[uint64]*blockHeader, error) {
+	res := make(map[uint64]*blockHeader, len(numbers))
+	for i := 0; i < len(numbers); i += headerBatchSize {
+		ns := numbers[i:]
+		if len(ns) > headerBatchSize {
+			ns = ns[:headerBatchSize]
+		}
+		hs := make([]*blockHeader, len(ns))
+		batch := make([]rpc.BatchElem, len(ns))
+		for j, n := range ns {
+			batch[j] = rpc.BatchElem{
+				Method: "eth_getBlockByNumber",
+				Args: []interface{}{hexutil.EncodeUint64(n), false},
+				Result: &hs[j],
+			}
+		}
+		err := rc.BatchCallContext(ctx, batch)
+		if err != nil {
+			return nil, rpcError("rpc.BatchCallContext", err)
+		}
+		for j, e := range batch {
+			if e.Error != nil {
+				return nil, rpcError("eth_getBlockByNumber", e.Error)
+			}
+			if hs[j] == nil {
+				return nil, rpcError("eth_getBlockByNumber", ethereum.NotFound)
+			}
+			res[ns[j]] = hs[j]
+		}
+	}
+	return res, nil
+}
+
+// logBlocks returns the distinct block numbers of logs in ascending order.
+func logBlocks(logs []types.Log) []uint64 {
+	seen := make(map[uint64]bool)
+	ns := []uint64{}
+	for _, l := range logs {
+		if !seen[l.BlockNumber] {
+			seen[l.BlockNumber] = true
+			ns = append(ns, l.BlockNumber)
+		}
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i] < ns[j] })
+	return ns
+}
+
+// logHeaders adds the headers of the blocks of logs missing from headers,
+// which may be nil. It returns false if a log is not in the block of the
+// fetched header, as the chain changed since the logs were fetched.
+func (s *uniswapSync) logHeaders(headers map[uint64]*blockHeader, logs []types.Log) (map[uint64]*blockHeader, bool, error) {
+	if headers == nil {
+		headers = make(map[uint64]*blockHeader)
+	}
+	missing := []uint64{}
+	for _, n := range logBlocks(logs) {
+		if _, ok := headers[n]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	fetched, err := getHeaders(s.dbCtx, s.rc, missing)
+	if err != nil {
+		return nil, false, err
+	}
+	for n, h := range fetched {
+		headers[n] = h
+	}
+
+	for _, l := range logs {
+		h := headers[l.BlockNumber]
+		if h.Hash() != l.BlockHash {
+			log.Warn("reorg while syncing: log block hash mismatch", "block", l.BlockNumber, "header", h.Hash().Hex(), "log", l.BlockHash.Hex())
+			return nil, false, nil
+		}
+	}
+	return headers, true, nil
+}
+
+// dbUpsertBlocks writes headers to the blocks table in one batch.
+func dbUpsertBlocks(ctx context.Context, tx pgx.Tx, headers map[uint64]*blockHeader) error {
+	ns := make([]uint64, 0, len(headers))
+	for n := range headers {
+		ns = append(ns, n)
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i] < ns[j] })
+
+	q := "INSERT INTO blocks (number, hash, parent_hash, time, miner, gas_limit, gas_used, difficulty) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) " +
+		"ON CONFLICT (number) DO UPDATE SET hash = EXCLUDED.hash, parent_hash = EXCLUDED.parent_hash, " +
+		"time = EXCLUDED.time, miner = EXCLUDED.miner, gas_limit = EXCLUDED.gas_limit, " +
+		"gas_used = EXCLUDED.gas_used, difficulty = EXCLUDED.difficulty"
+	b := &pgx.Batch{}
+	for _, n := range ns {
+		h := headers[n]
+		b.Queue(q, n, h.Hash().Hex(), h.ParentHash.Hex(), time.Unix(int64(h.Time), 0).UTC(),
+			h.Coinbase.Hex(), h.GasLimit, h.GasUsed, dbNumeric(h.Difficulty))
+	}
+	br := tx.SendBatch(ctx, b)
+	for range ns {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return dbError("tx.SendBatch", err)
+		}
+	}
+	err := br.Close()
+	if err != nil {
+		return dbError("tx.SendBatch", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// OHLCV candles.
+//
+// Candles of every pair are kept in the candles table for the periods in
+// candlePeriods. Prices are the spot price of token0 in token1 after each
+// Sync, as price0 of pair_state; volume0 and volume1 are the token0 and
+// token1 amounts swapped in and out, scaled by the token decimals.
+//
+// Candles are derived from the event tables and the block times only:
+// the candles of the shortest period are computed from the events, every
+// longer period from the candles of the one before it. After each range
+// is synced all candles overlapping the times of its blocks are deleted
+// and computed again in the same transaction, so building candles for any
+// block range again gives the same result.
+
+// candlePeriods are ordered by length; each length is a multiple of the
+// one before.
+var candlePeriods = []struct {
+	name string
+	d time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// dbBuildCandles computes the candles of all periods overlapping the times
+// of blocks in [fromBlock, toBlock].
+func dbBuildCandles(ctx context.Context, dbConn dbQuerier, fromBlock, toBlock uint64) error {
+	t0, t1, err := dbBlockTimes(ctx, dbConn, fromBlock, toBlock)
+	if err != nil || t0 == nil {
+		return err
+	}
+	return dbBuildCandlesTime(ctx, dbConn, *t0, *t1)
+}
+
+// dbBlockTimes returns the times of the first and last recorded block in
+// [fromBlock, toBlock], nil if there is none.
+func dbBlockTimes(ctx context.Context, dbConn dbQuerier, fromBlock, toBlock uint64) (*time.Time, *time.Time, error) {
+	q := "SELECT min(time), max(time) FROM blocks WHERE number BETWEEN $1 AND $2"
+	rows, err := dbConn.Query(ctx, q, fromBlock, toBlock)
+	if err != nil {
+		return nil, nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	var t0, t1 *time.Time
+	for rows.Next() {
+		err = rows.Scan(&t0, &t1)
+		if err != nil {
+			return nil, nil, dbError("rows.Scan", err)
+		}
+	}
+	return t0, t1, dbRowsErr(rows)
+}
+
+// dbBuildCandlesTime computes the candles of all periods overlapping
+// [t0, t1].
+func dbBuildCandlesTime(ctx context.Context, dbConn dbQuerier, t0, t1 time.Time) error {
+	for i, p := range candlePeriods {
+		from, to := t0.Truncate(p.d), t1.Truncate(p.d).Add(p.d)
+		err := dbExec(ctx, dbConn, "DELETE FROM candles WHERE period = $1 AND start >= $2 AND start < $3",
+			[]interface{}{p.name, from, to})
+		if err != nil {
+			return err
+		}
+
+		secs := int32(p.d / time.Second)
+		if i == 0 {
+			err = dbExec(ctx, dbConn, candlesFromEventsSQL, []interface{}{p.name, secs, from, to})
+		} else {
+			err = dbExec(ctx, dbConn, candlesFromCandlesSQL, []interface{}{p.name, secs, from, to, candlePeriods[i-1].name})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candlesFromEventsSQL inserts the candles of period $1 of $2 seconds
+// starting in [$3, $4] from Sync and Swap events. Buckets without a known
+// price, because the decimals of a token are unknown, have no candle.
+const candlesFromEventsSQL = `
+WITH prices AS (
+	SELECT s.pair_id, candle_start(b.time, $2::INTEGER) AS start, s.block, s.log_index,
+		spot_price(s.reserve0, t0.decimals, s.reserve1, t1.decimals) AS price
+	FROM us_pair_sync s
+	JOIN blocks b ON b.number = s.block
+	JOIN us_factory f ON f.pair_id = s.pair_id
+	LEFT JOIN tokens t0 ON t0.addr = f.token0
+	LEFT JOIN tokens t1 ON t1.addr = f.token1
+	WHERE b.time >= $3 AND b.time < $4
+), ohlc AS (
+	SELECT pair_id, start,
+		(array_agg(price ORDER BY block, log_index NULLS FIRST))[1] AS open,
+		max(price) AS high,
+		min(price) AS low,
+		(array_agg(price ORDER BY block DESC, log_index DESC NULLS LAST))[1] AS close,
+		min(block) AS first_block,
+		max(block) AS last_block
+	FROM prices
+	WHERE price IS NOT NULL
+	GROUP BY pair_id, start
+), volumes AS (
+	SELECT w.pair_id, candle_start(b.time, $2::INTEGER) AS start,
+		sum(token_amount(w.amount0in + w.amount0out, t0.decimals)) AS volume0,
+		sum(token_amount(w.amount1in + w.amount1out, t1.decimals)) AS volume1,
+		count(*) AS trades
+	FROM us_pair_swap w
+	JOIN blocks b ON b.number = w.block
+	JOIN us_factory f ON f.pair_id = w.pair_id
+	LEFT JOIN tokens t0 ON t0.addr = f.token0
+	LEFT JOIN tokens t1 ON t1.addr = f.token1
+	WHERE b.time >= $3 AND b.time < $4
+	GROUP BY w.pair_id, start
+)
+INSERT INTO candles (pair_id, period, start, open, high, low, close, volume0, volume1, trades, first_block, last_block)
+SELECT o.pair_id, $1::TEXT, o.start, o.open, o.high, o.low, o.close,
+	coalesce(v.volume0, 0), coalesce(v.volume1, 0), coalesce(v.trades, 0), o.first_block, o.last_block
+FROM ohlc o
+LEFT JOIN volumes v ON v.pair_id = o.pair_id AND v.start = o.start
+`
+
+// candlesFromCandlesSQL inserts the candles of period $1 of $2 seconds
+// starting in [$3, $4] from the candles of the shorter period $5.
+const candlesFromCandlesSQL = `
+INSERT INTO candles (pair_id, period, start, open, high, low, close, volume0, volume1, trades, first_block, last_block)
+SELECT pair_id, $1::TEXT, candle_start(start, $2::INTEGER) AS s,
+	(array_agg(open ORDER BY start))[1],
+	max(high),
+	min(low),
+	(array_agg(close ORDER BY start DESC))[1],
+	sum(volume0),
+	sum(volume1),
+	sum(trades),
+	min(first_block),
+	max(last_block)
+FROM candles
+WHERE period = $5 AND start >= $3 AND start < $4
+GROUP BY pair_id, s
+`
+
+// RebuildCandles computes the candles overlapping the times of blocks in
+// [fromBlock, toBlock] again, in one transaction.
+func RebuildCandles(ctx context.Context, cfg *Config, fromBlock, toBlock uint64) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return dbError("dbPool.Begin", err)
+	}
+	defer tx.Rollback(ctx)
+
+	t0 := time.Now()
+	err = dbBuildCandles(ctx, tx, fromBlock, toBlock)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return dbError("tx.Commit", err)
+	}
+	log.Info("rebuilt candles", "fromBlock", fromBlock, "toBlock", toBlock, "t", time.Since(t0))
+	return nil
+}
@@ -19,9 +19,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/urfave/cli"
 
@@ -39,31 +45,501 @@ func main() {
 	app.Usage = ""
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name: "config",
+			EnvVar: "KANOT_CONFIG",
+			Usage: "YAML config file",
+		},
+		cli.StringFlag{
+			Name: "endpoint",
+			EnvVar: "KANOT_ENDPOINT",
+			Usage: "websocket endpoint of Ethereum full node",
+		},
+		cli.Uint64Flag{
+			Name: "confirmations",
+			EnvVar: "KANOT_CONFIRMATIONS",
+			Usage: "number of blocks behind head to sync to",
+		},
+		cli.BoolFlag{
+			Name: "lowlatency",
+			EnvVar: "KANOT_LOWLATENCY",
+			Usage: "sync up to head and roll back reorgs",
+		},
+		cli.BoolFlag{
+			Name: "enrichtxs",
+			EnvVar: "KANOT_ENRICHTXS",
+			Usage: "store sender, gas and status of event transactions",
+		},
+		cli.StringFlag{
+			Name: "db",
+			EnvVar: "KANOT_DB",
+			Usage: "PostgreSQL connection string",
+		},
+		cli.IntFlag{
+			Name: "dbmaxconns",
+			EnvVar: "KANOT_DBMAXCONNS",
+			Usage: "max PostgreSQL connections",
+		},
+		cli.DurationFlag{
+			Name: "pollingcycle",
+			EnvVar: "KANOT_POLLINGCYCLE",
+			Usage: "max time between syncs when following the head",
+		},
+		cli.Uint64Flag{
+			Name: "queryblocks",
+			EnvVar: "KANOT_QUERYBLOCKS",
+			Usage: "initial number of blocks per FilterLogs query",
+		},
+		cli.DurationFlag{
+			Name: "querytimeout",
+			EnvVar: "KANOT_QUERYTIMEOUT",
+			Usage: "timeout of a FilterLogs query",
+		},
+		cli.IntFlag{
+			Name: "workers",
+			EnvVar: "KANOT_WORKERS",
+			Usage: "number of concurrent FilterLogs workers",
+		},
+		cli.IntFlag{
+			Name: "copyflush",
+			EnvVar: "KANOT_COPYFLUSH",
+			Usage: "rows buffered per table before COPY, 1 to INSERT every row",
+		},
+		cli.StringFlag{
+			Name: "contracts",
+			EnvVar: "KANOT_CONTRACTS",
+			Usage: "directory of contract registry files",
+		},
+		cli.StringFlag{
+			Name: "abidir",
+			EnvVar: "KANOT_ABIDIR",
+			Usage: "directory of ABI files used by the contract registry",
+		},
+		cli.StringFlag{
+			Name: "tokens",
+			EnvVar: "KANOT_TOKENS",
+			Usage: "YAML file of token metadata overrides",
+		},
+		cli.StringFlag{
+			Name: "pprof",
+			EnvVar: "KANOT_PPROF",
+			Usage: "listen address of the pprof server, empty to disable",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name: "migrate",
+			Usage: "apply pending schema migrations and exit",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name: "down",
+					Value: -1,
+					Usage: "revert migrations down to the given schema version",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				if c.Int("down") >= 0 {
+					return kanot.MigrateDown(signalContext(), cfg, c.Int("down"))
+				}
+				return kanot.MigrateUp(signalContext(), cfg)
+			},
+		},
+		{
+			Name: "bench",
+			Usage: "compare per-row INSERT and COPY ingestion throughput",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name: "rows",
+					Value: 100000,
+					Usage: "number of synthetic rows written per run",
+				},
+				cli.IntSliceFlag{
+					Name: "flush",
+					Usage: "flush sizes to compare, 1 is the per-row INSERT path (default: 1, 100, 1000, 10000)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				flushSizes := c.IntSlice("flush")
+				if len(flushSizes) == 0 {
+					flushSizes = []int{1, 100, 1000, 10000}
+				}
+				return kanot.BenchInsert(signalContext(), cfg, c.Int("rows"), flushSizes)
+			},
+		},
+		{
+			Name: "relabel",
+			Usage: "apply token overrides and update the labels of all pairs",
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				return kanot.RelabelPairs(signalContext(), cfg)
+			},
+		},
+		{
+			Name: "reserves",
+			Usage: "print the reserves and prices of a pair after the last Sync at or before a block",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "pair",
+					Usage: "pair_id of the pair",
+				},
+				cli.Uint64Flag{
+					Name: "block",
+					Usage: "block number, 0 for the latest synced block",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				block := c.Uint64("block")
+				if block == 0 {
+					block = math.MaxInt64
+				}
+				ps, err := kanot.ReservesAt(signalContext(), cfg, c.Uint64("pair"), block)
+				if err != nil {
+					return err
+				}
+				if ps == nil {
+					return fmt.Errorf("no Sync of pair %d at or before block %d", c.Uint64("pair"), block)
+				}
+				fmt.Println("block   ", ps.Block)
+				fmt.Println("reserve0", ps.Reserve0)
+				fmt.Println("reserve1", ps.Reserve1)
+				fmt.Println("k       ", ps.K)
+				if ps.Price0 != nil && ps.Price1 != nil {
+					fmt.Println("price0  ", ps.Price0.FloatString(18))
+					fmt.Println("price1  ", ps.Price1.FloatString(18))
+				}
+				return nil
+			},
+		},
+		{
+			Name: "twap",
+			Usage: "print the time-weighted average prices of a pair",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "pair",
+					Usage: "pair_id of the pair",
+				},
+				cli.StringFlag{
+					Name: "from",
+					Usage: "start of the period, RFC 3339",
+				},
+				cli.StringFlag{
+					Name: "to",
+					Usage: "end of the period, RFC 3339",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				from, err := time.Parse(time.RFC3339, c.String("from"))
+				if err != nil {
+					return err
+				}
+				to, err := time.Parse(time.RFC3339, c.String("to"))
+				if err != nil {
+					return err
+				}
+				tw, err := kanot.TWAP(signalContext(), cfg, c.Uint64("pair"), from, to)
+				if err != nil {
+					return err
+				}
+				fmt.Println("price0x112", tw.Price0X112)
+				fmt.Println("price1x112", tw.Price1X112)
+				if tw.Price0 != nil && tw.Price1 != nil {
+					fmt.Println("price0    ", tw.Price0.FloatString(18))
+					fmt.Println("price1    ", tw.Price1.FloatString(18))
+				}
+				return nil
+			},
+		},
+		{
+			Name: "checktwap",
+			Usage: "compare the cumulative prices of a pair derived from Sync events to an archive node",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "pair",
+					Usage: "pair_id of the pair",
+				},
+				cli.Uint64Flag{
+					Name: "block",
+					Usage: "block number",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				return kanot.CheckCumulativePrices(signalContext(), cfg, c.Uint64("pair"), c.Uint64("block"))
+			},
+		},
+		{
+			Name: "position",
+			Usage: "print the LP token balance of a holder and its share of the reserves",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "pair",
+					Usage: "pair_id of the pair",
+				},
+				cli.StringFlag{
+					Name: "holder",
+					Usage: "address of the holder",
+				},
+				cli.Uint64Flag{
+					Name: "block",
+					Usage: "block number, 0 for the latest synced block",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				if !common.IsHexAddress(c.String("holder")) {
+					return fmt.Errorf("invalid holder address %q", c.String("holder"))
+				}
+				block := c.Uint64("block")
+				if block == 0 {
+					block = math.MaxInt64
+				}
+				pos, err := kanot.LPPositionAt(signalContext(), cfg, c.Uint64("pair"), common.HexToAddress(c.String("holder")), block)
+				if err != nil {
+					return err
+				}
+				fmt.Println("balance ", pos.Balance)
+				fmt.Println("supply  ", pos.TotalSupply)
+				if pos.Amount0 != nil && pos.Amount1 != nil {
+					fmt.Println("amount0 ", pos.Amount0)
+					fmt.Println("amount1 ", pos.Amount1)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "lpreport",
+			Usage: "print the value, fees and impermanent loss of an LP position over time",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "pair",
+					Usage: "pair_id of the pair",
+				},
+				cli.StringFlag{
+					Name: "holder",
+					Usage: "address of the holder",
+				},
+				cli.Uint64Flag{
+					Name: "block",
+					Usage: "last block, 0 for the latest synced block",
+				},
+				cli.Uint64Flag{
+					Name: "step",
+					Usage: "blocks between points besides balance changes, 0 for balance changes only",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				if !common.IsHexAddress(c.String("holder")) {
+					return fmt.Errorf("invalid holder address %q", c.String("holder"))
+				}
+				block := c.Uint64("block")
+				if block == 0 {
+					block = math.MaxInt64
+				}
+				r, err := kanot.LPReportAt(signalContext(), cfg, c.Uint64("pair"), common.HexToAddress(c.String("holder")), block, c.Uint64("step"))
+				if err != nil {
+					return err
+				}
+				fmt.Println("block\tbalance\tprice\tentry\tvalue\thodl\tfees\til")
+				for _, p := range r.Points {
+					il := "-"
+					if p.IL != nil {
+						il = p.IL.Text('f', 6)
+					}
+					fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Block, p.Balance, p.Price.Text('g', 10),
+						p.EntryValue.Text('f', 6), p.Value.Text('f', 6), p.HODLValue.Text('f', 6), p.Fees.Text('f', 6), il)
+				}
+				if r.KLast != nil {
+					fmt.Println("klast   ", r.KLast, "at block", r.KLastBlock)
+				}
+				if r.KGrowth != nil {
+					fmt.Println("kgrowth ", r.KGrowth.Text('f', 6))
+				}
+				return nil
+			},
+		},
+		{
+			Name: "candles",
+			Usage: "compute the candles of a block range again",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name: "from",
+					Usage: "first block",
+				},
+				cli.Uint64Flag{
+					Name: "to",
+					Value: math.MaxInt64,
+					Usage: "last block",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				return kanot.RebuildCandles(signalContext(), cfg, c.Uint64("from"), c.Uint64("to"))
+			},
+		},
+		{
+			Name: "contracts",
+			Usage: "print the DDL of the event tables of the contract registry",
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				r, err := kanot.LoadRegistry(cfg.ContractsDir, cfg.ABIDir)
+				if err != nil {
+					return err
+				}
+				for _, q := range r.DDL() {
+					fmt.Println(q + ";")
+				}
+				return nil
+			},
+		},
+		{
+			Name: "checksql",
+			Usage: "write pairs with hostile token symbols in a rolled back transaction",
+			Action: func(c *cli.Context) error {
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return err
+				}
+				return kanot.CheckSQL(signalContext(), cfg)
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
-		sigs := make(chan os.Signal, 1)
-		done := make(chan bool, 1)
-	
-		signal.Notify(sigs, os.Interrupt)
-	
-		go func() {
-			<-sigs
-			done <- true
-		}()
-		
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		ctx := signalContext()
+
 		log.Info("Kano Terminal Server", "version", app.Version)
-		go kanot.SyncETH()
-		
-		<-done
-		log.Info("shutting down...")
-		// TODO: close DB conns etc
+		err = kanot.SyncETH(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		log.Info("shut down")
 
 		return nil
 	}
 
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Error("app.Run:", "err", err)
+		log.Error("app.Run:", "err", err, "errors", kanot.ErrorCounts())
+		os.Exit(1)
+	}
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+// A second signal exits immediately.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		log.Info("shutting down...")
+		cancel()
+		<-sigs
+		log.Warn("forced shutdown")
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// loadConfig applies the config file, then environment variables and flags,
+// on top of kanot.DefaultConfig.
+func loadConfig(c *cli.Context) (*kanot.Config, error) {
+	cfg := kanot.DefaultConfig
+	if c.GlobalIsSet("config") {
+		err := kanot.LoadConfigFile(&cfg, c.GlobalString("config"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.GlobalIsSet("endpoint") {
+		cfg.Endpoint = c.GlobalString("endpoint")
 	}
+	if c.GlobalIsSet("confirmations") {
+		cfg.BlockConfirmations = c.GlobalUint64("confirmations")
+	}
+	if c.GlobalIsSet("lowlatency") {
+		cfg.LowLatency = c.GlobalBool("lowlatency")
+	}
+	if c.GlobalIsSet("enrichtxs") {
+		cfg.EnrichTxs = c.GlobalBool("enrichtxs")
+	}
+	if c.GlobalIsSet("db") {
+		cfg.DBConnString = c.GlobalString("db")
+	}
+	if c.GlobalIsSet("dbmaxconns") {
+		cfg.PgxMaxConns = int32(c.GlobalInt("dbmaxconns"))
+	}
+	if c.GlobalIsSet("pollingcycle") {
+		cfg.PollingCycle = c.GlobalDuration("pollingcycle")
+	}
+	if c.GlobalIsSet("queryblocks") {
+		cfg.QueryBlockCount = c.GlobalUint64("queryblocks")
+	}
+	if c.GlobalIsSet("querytimeout") {
+		cfg.QueryTimeout = c.GlobalDuration("querytimeout")
+	}
+	if c.GlobalIsSet("workers") {
+		cfg.SyncWorkers = c.GlobalInt("workers")
+	}
+	if c.GlobalIsSet("copyflush") {
+		cfg.CopyFlushSize = c.GlobalInt("copyflush")
+	}
+	if c.GlobalIsSet("contracts") {
+		cfg.ContractsDir = c.GlobalString("contracts")
+	}
+	if c.GlobalIsSet("abidir") {
+		cfg.ABIDir = c.GlobalString("abidir")
+	}
+	if c.GlobalIsSet("tokens") {
+		cfg.TokenOverrides = c.GlobalString("tokens")
+	}
+	if c.GlobalIsSet("pprof") {
+		cfg.PprofAddr = c.GlobalString("pprof")
+	}
+
+	return &cfg, nil
 }
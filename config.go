@@ -0,0 +1,114 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the runtime configuration of kanot. DefaultConfig is
+// overridden by the config file, then by KANOT_* environment variables
+// and finally by command line flags (see cmd/kanotsrv).
+type Config struct {
+	//
+	// Ethereum
+	//
+	// websocket endpoint of Ethereum full node
+	Endpoint string `yaml:"endpoint"`
+
+	// number of blocks for high guarantee of no reorgs
+	BlockConfirmations uint64 `yaml:"block_confirmations"`
+
+	// ingest blocks at the tip and roll back reorgs, see reorg.go
+	LowLatency bool `yaml:"low_latency"`
+
+	// store sender, gas and status of the transactions of all events,
+	// see transactions.go
+	EnrichTxs bool `yaml:"enrich_txs"`
+
+	//
+	// PostgreSQL
+	//
+	DBConnString string `yaml:"db"`
+	PgxMaxConns int32 `yaml:"db_max_conns"`
+
+	//
+	// Performance Tuning
+	//
+	PollingCycle time.Duration `yaml:"polling_cycle"`
+	// initial FilterLogs window, see rangeSizer
+	QueryBlockCount uint64 `yaml:"query_block_count"`
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+	// concurrent FilterLogs workers, see uniswapSync.syncTo
+	SyncWorkers int `yaml:"sync_workers"`
+	// rows buffered per table before they are written with COPY,
+	// 1 writes every row with its own INSERT
+	CopyFlushSize int `yaml:"copy_flush_size"`
+
+	// directory of contract registry files and of the ABI files they
+	// refer to, see registry.go
+	ContractsDir string `yaml:"contracts"`
+	ABIDir string `yaml:"abi_dir"`
+
+	// YAML file of token metadata overrides, see LoadTokenOverrides
+	TokenOverrides string `yaml:"token_overrides"`
+
+	// listen address of the pprof HTTP server, empty to disable
+	PprofAddr string `yaml:"pprof"`
+}
+
+var DefaultConfig = Config{
+	Endpoint: "ws://127.0.0.1:13516",
+	BlockConfirmations: 15,
+	LowLatency: false,
+	EnrichTxs: false,
+
+	DBConnString: "host=127.0.0.1 port=5432 dbname=dev1 user=kanot password=kanot",
+	PgxMaxConns: 6,
+
+	PollingCycle: 300 * time.Second,
+	QueryBlockCount: 32,
+	QueryTimeout: 240 * time.Second,
+	SyncWorkers: 4,
+	CopyFlushSize: 1000,
+
+	ContractsDir: "",
+	ABIDir: "abis",
+	TokenOverrides: "",
+
+	PprofAddr: "localhost:6060",
+}
+
+// LoadConfigFile reads a YAML config file on top of cfg. Keys missing
+// from the file keep their value in cfg.
+func LoadConfigFile(cfg *Config, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(b, cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -20,59 +20,146 @@ package kanot
 
 import (
 	"context"
-	"math"
+	"fmt"
 	"math/big"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 
-	//"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-var dbPool *pgxpool.Pool
+// dbPool is open while an exported function that uses the database runs,
+// see acquireDBPool.
+var (
+	dbPoolMu sync.Mutex
+	dbPoolRefs int
+	dbPool *pgxpool.Pool
+)
+
+// acquireDBPool opens dbPool with the DB settings of cfg unless a caller
+// that is still running opened it already. The returned release must be
+// called when done; the last one closes the pool, so that later calls
+// connect again with their own cfg.
+func acquireDBPool(ctx context.Context, cfg *Config) (func(), error) {
+	dbPoolMu.Lock()
+	defer dbPoolMu.Unlock()
+	if dbPool == nil {
+		err := initDBPool(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dbPoolRefs++
+	return func() {
+		dbPoolMu.Lock()
+		defer dbPoolMu.Unlock()
+		dbPoolRefs--
+		if dbPoolRefs == 0 {
+			dbPool.Close()
+			dbPool = nil
+		}
+	}, nil
+}
+
+// dbTables is the closed set of tables kanot reads and writes. Table names
+// are the only part of a statement not passed as bound parameter, so every
+// name spliced into SQL must come from this set, see dbTable.
+var dbTables = func() map[string]bool {
+	m := map[string]bool{"us_factory": true, "blocks": true, "sync_cursor": true, "tokens": true, "transactions": true, "pair_state": true, "candles": true, "lp_balances": true, "lp_supply": true}
+	for _, t := range usPairEventTables {
+		m["us_pair_"+t] = true
+	}
+	return m
+}()
+
+// dbRegistryTables are the event tables of the contract registry, see
+// addDBTable.
+var (
+	dbRegistryTablesMu sync.RWMutex
+	dbRegistryTables = make(map[string]bool)
+)
+
+var dbTableNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// addDBTable adds an event table of the contract registry to the tables
+// that can be used in SQL.
+func addDBTable(table string) error {
+	if !dbTableNameRe.MatchString(table) || len(table) > 48 {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	if dbTables[table] {
+		return fmt.Errorf("table %q is a kanot table", table)
+	}
+	dbRegistryTablesMu.Lock()
+	dbRegistryTables[table] = true
+	dbRegistryTablesMu.Unlock()
+	return nil
+}
+
+// dbTable returns the quoted identifier of table, or an error if table is
+// neither in dbTables nor a registry table.
+func dbTable(table string) (string, error) {
+	dbRegistryTablesMu.RLock()
+	ok := dbTables[table] || dbRegistryTables[table]
+	dbRegistryTablesMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("table %q is not a kanot table", table)
+	}
+	return pgx.Identifier{table}.Sanitize(), nil
+}
 
-func initDBPool() {
-	config, err := pgxpool.ParseConfig(dbConnString)
+// dbQuerier is implemented by both *pgxpool.Conn and pgx.Tx, so that
+// helpers can be used inside and outside of transactions.
+type dbQuerier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func initDBPool(ctx context.Context, cfg *Config) error {
+	config, err := pgxpool.ParseConfig(cfg.DBConnString)
 	if err != nil {
-		log.Error("pgxpool.ParseConfig", "err", err)
-		panic(err)
+		return dbError("pgxpool.ParseConfig", err)
 	}
 
 	hours, _ := time.ParseDuration(pgxMaxConnTime)
 	config.MaxConnLifetime = hours
 	config.MaxConnIdleTime = hours
 
-	config.MaxConns = pgxMaxConns
+	config.MaxConns = cfg.PgxMaxConns
 
-	p, err := pgxpool.ConnectConfig(context.Background(), config)
+	p, err := pgxpool.ConnectConfig(ctx, config)
 	if err != nil {
-		log.Error("pgxpool.Connect", "err", err)
-		panic(err)
-	} else {
-		dbPool = p
-		log.Info("pgxpool.Connect OK")
+		return dbError("pgxpool.Connect", err)
 	}
+	dbPool = p
+	log.Info("pgxpool.Connect OK")
+	return nil
 }
 
-func dbExec(dbConn *pgxpool.Conn, sql string, args []interface{}) {
+func dbExec(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) error {
 	//t0 := time.Now()
-	_, err := dbConn.Exec(context.Background(), sql, args...)
+	_, err := dbConn.Exec(ctx, sql, args...)
 	if err != nil {
 		log.Error("dbConn.Exec", "err", err, "sql", sql, "args", args)
-		return
+		return dbError("dbConn.Exec", err)
 	}
 	//t1 := time.Since(t0)
 	//log.Info("dbConn.Exec OK", "cmdtag", cmdTag, "t", t1)
+	return nil
 }
 
-func dbQueryUint64(dbConn *pgxpool.Conn, sql string, args []interface{}) uint64 {
+func dbQueryUint64(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) (uint64, error) {
 	//t0 := time.Now()
-	rows, err := dbConn.Query(context.Background(), sql, args...)
+	rows, err := dbConn.Query(ctx, sql, args...)
 	if err != nil {
-		log.Error("dbConn.Query", "err", err)
-		panic(err)
+		return 0, dbError("dbConn.Query", err)
 	}
 	defer rows.Close()
 	//t1 := time.Since(t0)
@@ -80,38 +167,30 @@ func dbQueryUint64(dbConn *pgxpool.Conn, sql string, args []interface{}) uint64
 
 	// empty table
 	if !rows.Next() {
-		return 0
+		return 0, dbRowsErr(rows)
 	}
 
 	var block uint64
 	err = rows.Scan(&block)
 	if err != nil {
-		log.Error("rows.Scan", "err", err)
-		panic(err)
-	}
-
-	// Any errors encountered by rows.Next or rows.Scan will be returned here
-	if rows.Err() != nil {
-		log.Error("rows.Err", "err", err)
-		panic(err)
+		return 0, dbError("rows.Scan", err)
 	}
 
-	return block
+	return block, dbRowsErr(rows)
 }
 
 type USV2PairCreated struct {
-	ticker string
+	label string
 	block uint64
 	tx_hash string
 	token0, token1, pair_addr string
 	pair_id uint64
 }
-func dbQueryPairsCreated(dbConn *pgxpool.Conn, sql string, args []interface{}) []*USV2PairCreated {
+func dbQueryPairsCreated(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) ([]*USV2PairCreated, error) {
 	//t0 := time.Now()
-	rows, err := dbConn.Query(context.Background(), sql, args...)
+	rows, err := dbConn.Query(ctx, sql, args...)
 	if err != nil {
-		log.Error("dbConn.Query", "err", err)
-		panic(err)
+		return nil, dbError("dbConn.Query", err)
 	}
 	defer rows.Close()
 	//t1 := time.Since(t0)
@@ -120,57 +199,64 @@ func dbQueryPairsCreated(dbConn *pgxpool.Conn, sql string, args []interface{}) [
 	pairs := []*USV2PairCreated{}
 	for rows.Next() {
 		var block, pair_id uint64
-		var ticker, tx_hash, token0, token1, pair_addr string
-		err = rows.Scan(&ticker, &block, &tx_hash, &token0, &token1, &pair_addr, &pair_id)
+		var label, tx_hash, token0, token1, pair_addr string
+		err = rows.Scan(&label, &block, &tx_hash, &token0, &token1, &pair_addr, &pair_id)
 		if err != nil {
-			log.Error("rows.Scan", "err", err)
-			panic(err)
+			return nil, dbError("rows.Scan", err)
 		}
-		pair := USV2PairCreated{ticker, block, tx_hash, token0, token1, pair_addr, pair_id}
+		pair := USV2PairCreated{label, block, tx_hash, token0, token1, pair_addr, pair_id}
 		pairs = append(pairs, &pair)
 	}
 
-	// Any errors encountered by rows.Next or rows.Scan will be returned here
-	if rows.Err() != nil {
-		log.Error("rows.Err", "err", err)
-		panic(err)
-	}
-
-	return pairs
+	return pairs, dbRowsErr(rows)
 }
 
-func dbQueryPairTickers(dbConn *pgxpool.Conn, sql string) []string {
-	rows, err := dbConn.Query(context.Background(), sql)
+func dbQueryPairLabels(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) ([]string, error) {
+	rows, err := dbConn.Query(ctx, sql, args...)
 	if err != nil {
-		log.Error("dbConn.Query", "err", err)
-		panic(err)
+		return nil, dbError("dbConn.Query", err)
 	}
 	defer rows.Close()
 
 	res := []string{}
 	for rows.Next() {
-		var ticker string
-		err := rows.Scan(&ticker)
+		var label string
+		err := rows.Scan(&label)
 		if err != nil {
-			log.Error("rows.Scan", "err", err)
-			panic(err)
+			return nil, dbError("rows.Scan", err)
 		}
-		res = append(res, ticker)
+		res = append(res, label)
 	}
 
-	if rows.Err() != nil {
-		log.Error("rows.Err", "err", err)
-		panic(err)
+	return res, dbRowsErr(rows)
+}
+
+func dbQueryAddrBlocks(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) ([]common.Address, []uint64, error) {
+	rows, err := dbConn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	addrs, blocks := []common.Address{}, []uint64{}
+	for rows.Next() {
+		var addr string
+		var block uint64
+		err := rows.Scan(&addr, &block)
+		if err != nil {
+			return nil, nil, dbError("rows.Scan", err)
+		}
+		addrs = append(addrs, common.HexToAddress(addr))
+		blocks = append(blocks, block)
 	}
 
-	return res
+	return addrs, blocks, dbRowsErr(rows)
 }
 
-func dbQueryAddrs(dbConn *pgxpool.Conn, sql string) []common.Address {
-	rows, err := dbConn.Query(context.Background(), sql)
+func dbQueryAddrs(ctx context.Context, dbConn dbQuerier, sql string, args []interface{}) ([]common.Address, error) {
+	rows, err := dbConn.Query(ctx, sql, args...)
 	if err != nil {
-		log.Error("dbConn.Query", "err", err)
-		panic(err)
+		return nil, dbError("dbConn.Query", err)
 	}
 	defer rows.Close()
 
@@ -179,30 +265,89 @@ func dbQueryAddrs(dbConn *pgxpool.Conn, sql string) []common.Address {
 		var addr string
 		err := rows.Scan(&addr)
 		if err != nil {
-			log.Error("rows.Scan", "err", err)
-			panic(err)
+			return nil, dbError("rows.Scan", err)
 		}
 		res = append(res, common.HexToAddress(addr))
 	}
 
-	if rows.Err() != nil {
-		log.Error("rows.Err", "err", err)
-		panic(err)
-	}
+	return res, dbRowsErr(rows)
+}
 
-	return res
+// recordedBlock is a row of the blocks table.
+type recordedBlock struct {
+	hash, parentHash string
 }
 
-// TODO: this is just for testing; remove when moving to postgresql numeric
-func BigToFloat(bi *big.Int) float64 {
-	bf := new(big.Float).SetInt(bi)
-	f, acc := bf.Float64()
-	if acc != big.Exact {
-		if f == 0 || f == -0 || f == math.Inf(1) || f == math.Inf(-1) {
-			log.Error("big.Float.Float64", "float64", f, "Accuracy", acc)
-		} else {
-			log.Warn("big.Float.Float64", "float64", f, "Accuracy", acc)
+// dbQueryBlockHashes returns the hashes of the blocks recorded within
+// reorgMaxDepth of the recorded tip.
+func dbQueryBlockHashes(ctx context.Context, dbConn dbQuerier) (map[uint64]*recordedBlock, error) {
+	q := "SELECT number, hash, parent_hash FROM blocks WHERE number > (SELECT max(number) FROM blocks) - $1"
+	rows, err := dbConn.Query(ctx, q, reorgMaxDepth)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	res := make(map[uint64]*recordedBlock)
+	for rows.Next() {
+		var n uint64
+		b := &recordedBlock{}
+		err := rows.Scan(&n, &b.hash, &b.parentHash)
+		if err != nil {
+			return nil, dbError("rows.Scan", err)
 		}
+		res[n] = b
+	}
+
+	return res, dbRowsErr(rows)
+}
+
+// dbQuerySyncCursor returns the last fully committed block of the named
+// sync, and false if the sync has never committed a range.
+func dbQuerySyncCursor(ctx context.Context, dbConn dbQuerier, name string) (uint64, bool, error) {
+	rows, err := dbConn.Query(ctx, "SELECT block FROM sync_cursor WHERE name = $1", name)
+	if err != nil {
+		return 0, false, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, false, dbRowsErr(rows)
+	}
+
+	var block uint64
+	err = rows.Scan(&block)
+	if err != nil {
+		return 0, false, dbError("rows.Scan", err)
+	}
+
+	return block, true, dbRowsErr(rows)
+}
+
+func dbSetSyncCursor(ctx context.Context, dbConn dbQuerier, name string, block uint64) error {
+	q := "INSERT INTO sync_cursor (name, block) VALUES ($1, $2) " +
+		"ON CONFLICT (name) DO UPDATE SET block = EXCLUDED.block, updated_at = now()"
+	return dbExec(ctx, dbConn, q, []interface{}{name, block})
+}
+
+// dbRowsErr returns any error encountered by rows.Next or rows.Scan.
+func dbRowsErr(rows pgx.Rows) error {
+	if rows.Err() != nil {
+		return dbError("rows.Err", rows.Err())
 	}
-	return f
+	return nil
+}
+
+// numericInt returns the integer value of a NUMERIC with scale 0.
+func numericInt(n pgtype.Numeric) *big.Int {
+	if n.Exp <= 0 {
+		return n.Int
+	}
+	return new(big.Int).Mul(n.Int, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n.Exp)), nil))
+}
+
+// dbNumeric returns the NUMERIC encoding of an integer, which is binary and
+// exact for any uint256.
+func dbNumeric(b *big.Int) pgtype.Numeric {
+	return pgtype.Numeric{Int: b, Status: pgtype.Present}
 }
@@ -0,0 +1,73 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAcquireDBPool(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.DBConnString = "host=127.0.0.1 port=1 dbname=none user=none connect_timeout=1"
+	_, err := acquireDBPool(context.Background(), &cfg)
+	if !errors.Is(err, ErrDB) {
+		t.Errorf("acquireDBPool = %v, want ErrDB", err)
+	}
+	if dbPool != nil || dbPoolRefs != 0 {
+		t.Errorf("failed acquireDBPool left pool %v, refs %d", dbPool, dbPoolRefs)
+	}
+}
+
+// TestAcquireDBPoolRelease checks that the pool is closed by the last
+// release and opened again by the next caller.
+func TestAcquireDBPoolRelease(t *testing.T) {
+	cfg := testDBConfig(t)
+	ctx := context.Background()
+	release0, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := dbPool
+	release1, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbPool != p {
+		t.Errorf("nested acquireDBPool opened another pool")
+	}
+	release1()
+	if dbPool != p {
+		t.Errorf("pool closed while still acquired")
+	}
+	release0()
+	if dbPool != nil {
+		t.Errorf("pool not closed by the last release")
+	}
+
+	_, err = ReservesAt(ctx, cfg, 1, 0)
+	if err != nil {
+		t.Errorf("ReservesAt after release: %v", err)
+	}
+	if dbPool != nil {
+		t.Errorf("ReservesAt left the pool open")
+	}
+}
@@ -0,0 +1,291 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Generic log decoding.
+//
+// parseLog walks the inputs of the ABI event of a log, takes indexed
+// arguments from the topics and the others from the log data, and converts
+// every value to the column type given by columnType:
+//
+//	intN, uintN (N < 64)          BIGINT
+//	int64, uint64 and larger      NUMERIC(78,0)
+//	bool                          BOOLEAN
+//	address                       TEXT, checksummed hex
+//	string                        TEXT
+//	bytes, bytesN, function       TEXT, 0x-prefixed hex
+//	arrays, slices, tuples        JSONB
+//
+// Indexed strings, bytes, arrays and tuples are only available as the
+// keccak256 hash of their value and stored as TEXT hex.
+
+// decodedLog holds the arguments of a log as columns in the order of the
+// event inputs.
+type decodedLog struct {
+	event string
+	cols []string
+	// values as decoded by the abi package
+	raws []interface{}
+	// values converted for the columns
+	vals []interface{}
+}
+
+// raw returns the abi decoded value of column col, nil if there is none.
+func (d *decodedLog) raw(col string) interface{} {
+	for i, c := range d.cols {
+		if c == col {
+			return d.raws[i]
+		}
+	}
+	return nil
+}
+
+// columnRenames maps argument names to the column names used by the
+// existing tables, where they would otherwise be SQL keywords.
+var columnRenames = map[string]string{
+	"to": "dest",
+	"from": "sender",
+}
+
+// columnName returns the column of the i-th input of an event: its name in
+// lower case without leading underscores, or argI if it has none.
+func columnName(arg abi.Argument, i int) string {
+	name := strings.ToLower(strings.TrimLeft(arg.Name, "_"))
+	if name == "" {
+		return "arg" + strconv.Itoa(i)
+	}
+	if r, ok := columnRenames[name]; ok {
+		return r
+	}
+	return name
+}
+
+// columnType returns the SQL type of the column of an event input.
+func columnType(arg abi.Argument) string {
+	t := arg.Type
+	if arg.Indexed && isHashedTopic(t) {
+		return "TEXT"
+	}
+	switch t.T {
+	case abi.IntTy, abi.UintTy:
+		if t.Size < 64 {
+			return "BIGINT"
+		}
+		// 78 digits hold any uint256 and int256
+		return "NUMERIC(78,0)"
+	case abi.BoolTy:
+		return "BOOLEAN"
+	case abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return "JSONB"
+	}
+	return "TEXT"
+}
+
+// isHashedTopic reports whether indexed arguments of type t are stored as
+// the hash of their value.
+func isHashedTopic(t abi.Type) bool {
+	switch t.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return true
+	}
+	return false
+}
+
+// parseLog decodes a log of the contract of cs.
+func parseLog(l types.Log, cs ContractSync) (*decodedLog, error) {
+	_, _, cABI := cs.Contract()
+	eventName, err := cs.EventName(l.Topics)
+	if err != nil {
+		return nil, err
+	}
+	ev, ok := cABI.Events[eventName]
+	if !ok {
+		return nil, newError(ErrUnknownEvent, "abi.Events", fmt.Errorf("no event %s in ABI of %s", eventName, cs.Name()))
+	}
+	return decodeLog(&ev, l)
+}
+
+func decodeLog(ev *abi.Event, l types.Log) (*decodedLog, error) {
+	data, err := ev.Inputs.UnpackValues(l.Data)
+	if err != nil {
+		return nil, decodeError("Arguments.UnpackValues", err)
+	}
+
+	// topic 0 is the event signature, unless the event is anonymous
+	topics := l.Topics
+	if !ev.Anonymous && len(topics) > 0 {
+		topics = topics[1:]
+	}
+
+	d := &decodedLog{event: ev.RawName}
+	for i, arg := range ev.Inputs {
+		var v interface{}
+		if arg.Indexed {
+			if len(topics) == 0 {
+				return nil, decodeError("decodeLog", fmt.Errorf("%s: missing topic for %s", ev.RawName, arg.Name))
+			}
+			v, err = decodeTopic(arg, topics[0])
+			if err != nil {
+				return nil, err
+			}
+			topics = topics[1:]
+		} else {
+			v, data = data[0], data[1:]
+		}
+
+		dv, err := columnValue(arg, v)
+		if err != nil {
+			return nil, err
+		}
+		d.cols = append(d.cols, columnName(arg, i))
+		d.raws = append(d.raws, v)
+		d.vals = append(d.vals, dv)
+	}
+	return d, nil
+}
+
+func decodeTopic(arg abi.Argument, topic common.Hash) (interface{}, error) {
+	if isHashedTopic(arg.Type) {
+		return topic, nil
+	}
+	m := make(map[string]interface{})
+	arg.Name = "v"
+	err := abi.ParseTopicsIntoMap(m, abi.Arguments{arg}, []common.Hash{topic})
+	if err != nil {
+		return nil, decodeError("abi.ParseTopicsIntoMap", err)
+	}
+	return m["v"], nil
+}
+
+// columnValue converts a value decoded by the abi package to the column
+// type of arg.
+func columnValue(arg abi.Argument, v interface{}) (interface{}, error) {
+	if h, ok := v.(common.Hash); ok && arg.Indexed && isHashedTopic(arg.Type) {
+		return h.Hex(), nil
+	}
+	switch arg.Type.T {
+	case abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return jsonValue(arg.Type, reflect.ValueOf(v))
+	case abi.IntTy, abi.UintTy:
+		if arg.Type.Size >= 64 {
+			b, ok := toBig(reflect.ValueOf(v))
+			if !ok {
+				return nil, decodeError("columnValue", fmt.Errorf("%s: unexpected %T", arg.Type, v))
+			}
+			return dbNumeric(b), nil
+		}
+	}
+	return scalarValue(arg.Type, reflect.ValueOf(v), arg.Type.Size < 64)
+}
+
+// scalarValue converts a non-composite value, integers to int64 if small
+// or else to a decimal string as used in JSON.
+func scalarValue(t abi.Type, v reflect.Value, small bool) (interface{}, error) {
+	switch t.T {
+	case abi.IntTy, abi.UintTy:
+		b, ok := toBig(v)
+		if !ok {
+			return nil, decodeError("scalarValue", fmt.Errorf("%s: unexpected %s", t, v.Type()))
+		}
+		if small {
+			return b.Int64(), nil
+		}
+		return b.String(), nil
+	case abi.BoolTy:
+		return v.Bool(), nil
+	case abi.AddressTy:
+		return v.Interface().(common.Address).Hex(), nil
+	case abi.StringTy:
+		return cleanText(v.String()), nil
+	case abi.BytesTy:
+		return "0x" + hex.EncodeToString(v.Bytes()), nil
+	case abi.FixedBytesTy, abi.FunctionTy:
+		b := make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(b), v)
+		return "0x" + hex.EncodeToString(b), nil
+	case abi.HashTy:
+		return v.Interface().(common.Hash).Hex(), nil
+	}
+	return nil, decodeError("scalarValue", fmt.Errorf("unsupported type %s", t))
+}
+
+// jsonValue converts an array, slice or tuple to a value that encodes to
+// JSON losslessly: integers become decimal strings, tuples objects keyed
+// by field name.
+func jsonValue(t abi.Type, v reflect.Value) (interface{}, error) {
+	switch t.T {
+	case abi.SliceTy, abi.ArrayTy:
+		res := make([]interface{}, v.Len())
+		for i := range res {
+			e, err := jsonValue(*t.Elem, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			res[i] = e
+		}
+		return res, nil
+	case abi.TupleTy:
+		res := make(map[string]interface{})
+		for i, et := range t.TupleElems {
+			name := t.TupleRawNames[i]
+			if name == "" {
+				name = "arg" + strconv.Itoa(i)
+			}
+			e, err := jsonValue(*et, v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			res[name] = e
+		}
+		return res, nil
+	}
+	return scalarValue(t, v, false)
+}
+
+func toBig(v reflect.Value) (*big.Int, bool) {
+	if b, ok := v.Interface().(*big.Int); ok {
+		return b, true
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Int).SetUint64(v.Uint()), true
+	}
+	return nil, false
+}
+
+// cleanText removes what PostgreSQL TEXT cannot store from an on-chain
+// string: invalid UTF-8 and NUL bytes.
+func cleanText(s string) string {
+	return strings.Replace(strings.ToValidUTF8(s, ""), "\x00", "", -1)
+}
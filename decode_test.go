@@ -0,0 +1,292 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/jackc/pgtype"
+)
+
+const decodeTestABI = `[
+{"anonymous":false,"name":"Transfer","type":"event","inputs":[
+	{"indexed":true,"name":"from","type":"address"},
+	{"indexed":true,"name":"to","type":"address"},
+	{"indexed":false,"name":"value","type":"uint256"}]},
+{"anonymous":false,"name":"Mixed","type":"event","inputs":[
+	{"indexed":false,"name":"small","type":"uint8"},
+	{"indexed":false,"name":"_mid","type":"int32"},
+	{"indexed":false,"name":"big64","type":"uint64"},
+	{"indexed":false,"name":"neg","type":"int256"},
+	{"indexed":false,"name":"flag","type":"bool"},
+	{"indexed":false,"name":"id","type":"bytes32"},
+	{"indexed":false,"name":"data","type":"bytes"},
+	{"indexed":false,"name":"memo","type":"string"},
+	{"indexed":false,"name":"list","type":"uint256[]"},
+	{"indexed":false,"name":"pair","type":"tuple","components":[
+		{"name":"amount","type":"uint128"},
+		{"name":"owner","type":"address"}]},
+	{"indexed":false,"name":"","type":"uint16"}]},
+{"anonymous":false,"name":"Hashed","type":"event","inputs":[
+	{"indexed":true,"name":"name","type":"string"},
+	{"indexed":true,"name":"ids","type":"uint256[]"},
+	{"indexed":true,"name":"tag","type":"uint16"}]},
+{"anonymous":true,"name":"Note","type":"event","inputs":[
+	{"indexed":true,"name":"sig","type":"bytes4"},
+	{"indexed":true,"name":"guy","type":"address"},
+	{"indexed":false,"name":"wad","type":"uint256"}]}
+]`
+
+func decodeTestEvent(t *testing.T, name string) *abi.Event {
+	a, err := abi.JSON(strings.NewReader(decodeTestABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := a.Events[name]
+	return &ev
+}
+
+func numericValue(t *testing.T, v interface{}) *big.Int {
+	n, ok := v.(pgtype.Numeric)
+	if !ok {
+		t.Fatalf("value %v is %T, want pgtype.Numeric", v, v)
+	}
+	return numericInt(n)
+}
+
+func TestColumnType(t *testing.T) {
+	tests := []struct {
+		typ string
+		indexed bool
+		want string
+	}{
+		{"uint8", false, "BIGINT"},
+		{"int32", false, "BIGINT"},
+		{"uint56", false, "BIGINT"},
+		{"uint64", false, "NUMERIC(78,0)"},
+		{"int64", false, "NUMERIC(78,0)"},
+		{"uint112", false, "NUMERIC(78,0)"},
+		{"int256", true, "NUMERIC(78,0)"},
+		{"bool", false, "BOOLEAN"},
+		{"address", true, "TEXT"},
+		{"bytes32", false, "TEXT"},
+		{"bytes", false, "TEXT"},
+		{"string", false, "TEXT"},
+		{"uint256[]", false, "JSONB"},
+		{"address[2]", false, "JSONB"},
+		{"string", true, "TEXT"},
+		{"uint256[]", true, "TEXT"},
+	}
+	for _, tt := range tests {
+		typ, err := abi.NewType(tt.typ, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := columnType(abi.Argument{Name: "x", Type: typ, Indexed: tt.indexed})
+		if got != tt.want {
+			t.Errorf("columnType(%s, indexed %v) = %s, want %s", tt.typ, tt.indexed, got, tt.want)
+		}
+	}
+
+	ev := decodeTestEvent(t, "Mixed")
+	if got := columnType(ev.Inputs[9]); got != "JSONB" {
+		t.Errorf("columnType(tuple) = %s, want JSONB", got)
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	tests := []struct {
+		name string
+		i int
+		want string
+	}{
+		{"to", 1, "dest"},
+		{"from", 0, "sender"},
+		{"_from", 0, "sender"},
+		{"_amount", 2, "amount"},
+		{"Value", 2, "value"},
+		{"", 3, "arg3"},
+		{"__", 4, "arg4"},
+	}
+	for _, tt := range tests {
+		got := columnName(abi.Argument{Name: tt.name}, tt.i)
+		if got != tt.want {
+			t.Errorf("columnName(%q, %d) = %s, want %s", tt.name, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeLogTransfer(t *testing.T) {
+	ev := decodeTestEvent(t, "Transfer")
+	from := common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	to := common.HexToAddress("0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359")
+	value, _ := new(big.Int).SetString("115792089237316195423570985008687907853269984665640564039457584007913129639935", 10)
+	data, err := ev.Inputs.NonIndexed().Pack(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := types.Log{
+		Topics: []common.Hash{ev.ID, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data: data,
+	}
+
+	d, err := decodeLog(ev, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.event != "Transfer" {
+		t.Errorf("event = %s, want Transfer", d.event)
+	}
+	if !reflect.DeepEqual(d.cols, []string{"sender", "dest", "value"}) {
+		t.Errorf("cols = %v", d.cols)
+	}
+	if d.vals[0] != from.Hex() || d.vals[1] != to.Hex() {
+		t.Errorf("addresses = %v, %v", d.vals[0], d.vals[1])
+	}
+	if got := numericValue(t, d.vals[2]); got.Cmp(value) != 0 {
+		t.Errorf("value = %s, want %s", got, value)
+	}
+	if d.raw("dest") != to {
+		t.Errorf("raw(dest) = %v, want %s", d.raw("dest"), to.Hex())
+	}
+	if d.raw("missing") != nil {
+		t.Errorf("raw(missing) = %v, want nil", d.raw("missing"))
+	}
+
+	// indexed arguments without topics
+	l.Topics = l.Topics[:2]
+	_, err = decodeLog(ev, l)
+	if !errors.Is(err, ErrDecode) {
+		t.Errorf("decodeLog without topic: %v, want ErrDecode", err)
+	}
+	// truncated data
+	l.Topics = []common.Hash{ev.ID, {}, {}}
+	l.Data = data[:16]
+	_, err = decodeLog(ev, l)
+	if !errors.Is(err, ErrDecode) {
+		t.Errorf("decodeLog with short data: %v, want ErrDecode", err)
+	}
+}
+
+func TestDecodeLogMixed(t *testing.T) {
+	ev := decodeTestEvent(t, "Mixed")
+	owner := common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	pair := struct {
+		Amount *big.Int
+		Owner common.Address
+	}{big.NewInt(3), owner}
+	data, err := ev.Inputs.NonIndexed().Pack(uint8(7), int32(-3), uint64(1<<63), big.NewInt(-5), true,
+		[32]byte{0xab}, []byte{0xde, 0xad}, "memo\x00\xff", []*big.Int{big.NewInt(1), big.NewInt(2)}, pair, uint16(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := decodeLog(ev, types.Log{Topics: []common.Hash{ev.ID}, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCols := []string{"small", "mid", "big64", "neg", "flag", "id", "data", "memo", "list", "pair", "arg10"}
+	if !reflect.DeepEqual(d.cols, wantCols) {
+		t.Errorf("cols = %v, want %v", d.cols, wantCols)
+	}
+
+	if d.vals[0] != int64(7) || d.vals[1] != int64(-3) || d.vals[10] != int64(9) {
+		t.Errorf("small ints = %#v, %#v, %#v, want int64 7, -3, 9", d.vals[0], d.vals[1], d.vals[10])
+	}
+	if got := numericValue(t, d.vals[2]); got.Cmp(new(big.Int).SetUint64(1<<63)) != 0 {
+		t.Errorf("big64 = %s", got)
+	}
+	if got := numericValue(t, d.vals[3]); got.Cmp(big.NewInt(-5)) != 0 {
+		t.Errorf("neg = %s", got)
+	}
+	if d.vals[4] != true {
+		t.Errorf("flag = %v", d.vals[4])
+	}
+	if d.vals[5] != "0xab"+strings.Repeat("00", 31) {
+		t.Errorf("id = %v", d.vals[5])
+	}
+	if d.vals[6] != "0xdead" {
+		t.Errorf("data = %v", d.vals[6])
+	}
+	if d.vals[7] != "memo" {
+		t.Errorf("memo = %q", d.vals[7])
+	}
+
+	list, err := json.Marshal(d.vals[8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(list) != `["1","2"]` {
+		t.Errorf("list = %s", list)
+	}
+	tuple, err := json.Marshal(d.vals[9])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tuple) != `{"amount":"3","owner":"`+owner.Hex()+`"}` {
+		t.Errorf("pair = %s", tuple)
+	}
+}
+
+func TestDecodeLogHashedAndAnonymous(t *testing.T) {
+	ev := decodeTestEvent(t, "Hashed")
+	nameHash := crypto.Keccak256Hash([]byte("kanot"))
+	idsHash := common.HexToHash("0x1234")
+	l := types.Log{Topics: []common.Hash{ev.ID, nameHash, idsHash, common.BigToHash(big.NewInt(42))}}
+	d, err := decodeLog(ev, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{nameHash.Hex(), idsHash.Hex(), int64(42)}
+	if !reflect.DeepEqual(d.vals, want) {
+		t.Errorf("vals = %#v, want %#v", d.vals, want)
+	}
+
+	// topic 0 of anonymous events is an argument
+	ev = decodeTestEvent(t, "Note")
+	guy := common.HexToAddress("0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359")
+	data, err := ev.Inputs.NonIndexed().Pack(big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = types.Log{
+		Topics: []common.Hash{common.HexToHash("0xa9059cbb00000000000000000000000000000000000000000000000000000000"), common.BytesToHash(guy.Bytes())},
+		Data: data,
+	}
+	d, err = decodeLog(ev, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.vals[0] != "0xa9059cbb" || d.vals[1] != guy.Hex() {
+		t.Errorf("vals = %#v", d.vals)
+	}
+	if got := numericValue(t, d.vals[2]); got.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("wad = %s", got)
+	}
+}
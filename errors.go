@@ -0,0 +1,143 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// Errors returned by kanot wrap one of these, test with errors.Is.
+var (
+	// Ethereum node unavailable or call failed
+	ErrRPC = errors.New("rpc error")
+	// log or ABI could not be decoded
+	ErrDecode = errors.New("decode error")
+	// PostgreSQL unavailable or statement failed
+	ErrDB = errors.New("db error")
+	// log topic does not match any event of the contract ABI
+	ErrUnknownEvent = errors.New("unknown event")
+	// chain diverged below the blocks recorded for reorg detection
+	ErrReorg = errors.New("reorg too deep")
+)
+
+// errorCounts counts errors by kind, published at /debug/vars on the
+// pprof address.
+var errorCounts = expvar.NewMap("kanot_errors")
+
+// ErrorCounts returns the number of errors seen by kind since start.
+func ErrorCounts() map[string]int64 {
+	res := make(map[string]int64)
+	errorCounts.Do(func(kv expvar.KeyValue) {
+		res[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	return res
+}
+
+// kanotError wraps an error with its kind (one of the Err* sentinels) and
+// the failed operation.
+type kanotError struct {
+	kind error
+	op string
+	err error
+}
+
+func (e *kanotError) Error() string {
+	return e.kind.Error() + ": " + e.op + ": " + e.err.Error()
+}
+
+func (e *kanotError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kanotError) Unwrap() error {
+	return e.err
+}
+
+func newError(kind error, op string, err error) error {
+	errorCounts.Add(strings.Replace(kind.Error(), " ", "_", -1), 1)
+	return &kanotError{kind, op, err}
+}
+
+func rpcError(op string, err error) error {
+	return newError(ErrRPC, op, err)
+}
+
+func dbError(op string, err error) error {
+	return newError(ErrDB, op, err)
+}
+
+func decodeError(op string, err error) error {
+	return newError(ErrDecode, op, err)
+}
+
+// IsRetryable reports whether the operation that returned err may succeed
+// when retried: node and database connection problems are retryable,
+// decoding errors, unknown events and failed SQL statements are not.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrRPC) {
+		return true
+	}
+	if errors.Is(err, ErrDB) {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			// connection exception, transaction rollback (serialization
+			// failures, deadlocks), insufficient resources, operator
+			// intervention
+			switch pgErr.Code[:2] {
+			case "08", "40", "53", "57":
+				return true
+			}
+			return false
+		}
+		return isConnError(err)
+	}
+	return false
+}
+
+// isConnError reports whether err without server response is a failure of
+// the connection to PostgreSQL, rather than an error that fails the same
+// way every time, like encoding a value.
+func isConnError(err error) bool {
+	if pgconn.Timeout(err) {
+		return true
+	}
+	// pgconn.SafeToRetry only looks at err itself: conn closed or busy,
+	// failed before anything was sent
+	var safe interface{ SafeToRetry() bool }
+	if errors.As(err, &safe) && safe.SafeToRetry() {
+		return true
+	}
+	// refused, reset or failed to dial, also when acquiring from the pool
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// server closed the connection
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
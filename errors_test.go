@@ -0,0 +1,83 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	var n pgtype.Numeric
+	encodeErr := n.Set("not a number")
+	if encodeErr == nil {
+		t.Fatal("pgtype.Numeric.Set accepted a non-number")
+	}
+
+	tests := []struct {
+		name string
+		err error
+		want bool
+	}{
+		{"connection failure", dbError("tx.Exec", &pgconn.PgError{Code: "08006"}), true},
+		{"serialization failure", dbError("tx.Commit", &pgconn.PgError{Code: "40001"}), true},
+		{"deadlock", dbError("tx.Exec", &pgconn.PgError{Code: "40P01"}), true},
+		{"too many connections", dbError("pgxpool.Connect", &pgconn.PgError{Code: "53300"}), true},
+		{"admin shutdown", dbError("tx.Exec", &pgconn.PgError{Code: "57P01"}), true},
+		{"unique violation", dbError("tx.Exec", &pgconn.PgError{Code: "23505"}), false},
+		{"syntax error", dbError("tx.Exec", &pgconn.PgError{Code: "42601"}), false},
+		{"undefined column", dbError("tx.Exec", &pgconn.PgError{Code: "42703"}), false},
+		{"connection refused", dbError("dbPool.Acquire", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"network timeout", dbError("tx.Exec", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), true},
+		{"server closed connection", dbError("tx.Commit", fmt.Errorf("receive message failed: %w", io.ErrUnexpectedEOF)), true},
+		{"encode", dbError("tx.Exec", encodeErr), false},
+		{"table whitelist", dbError("dbTable", fmt.Errorf("table %q is not a kanot table", "pg_user")), false},
+		{"no rows", dbError("row.Scan", pgx.ErrNoRows), false},
+		{"wrapped non-network", dbError("tx.Exec", fmt.Errorf("flush: %w", errors.New("can't scan into dest[0]"))), false},
+		{"decode", decodeError("Arguments.UnpackValues", errors.New("abi: cannot marshal")), false},
+		{"unknown event", newError(ErrUnknownEvent, "abi.Events", errors.New("no event")), false},
+		{"rpc", rpcError("ethclient.FilterLogs", errors.New("connection refused")), true},
+		{"rpc cancelled", rpcError("ethclient.FilterLogs", context.Canceled), false},
+		{"cancelled", context.Canceled, false},
+		{"other", errors.New("invalid config"), false},
+	}
+	for _, tt := range tests {
+		got := IsRetryable(tt.err)
+		if got != tt.want {
+			t.Errorf("%s: IsRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
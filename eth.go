@@ -20,19 +20,23 @@ package kanot
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"time"
 	//"math"
 	"math/big"
 	//"encoding/hex"
 	"strings"
 	"os"
-	//"sync"
+	"sort"
+	"sync"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 
@@ -40,34 +44,38 @@ import (
 	_ "net/http/pprof"
 )
 
+// Runtime settings are in Config, see config.go
 const (
-	//
-	// Ethereum
-	//
-	// websocket endpoint of Ethereum full node
-	endpoint = "ws://127.0.0.1:13516"
+	// block hashes are recorded for the last reorgMaxDepth blocks in
+	// low latency mode, see reorg.go
+	reorgMaxDepth = 64
 
-	// number of blocks for high guarantee of no reorgs
-	blockConfirmations = 15
-
-	//
-	// PostgreSQL
-	//
-	dbConnString = "host=127.0.0.1 port=5432 dbname=dev1 user=kanot password=kanot"
+	// name of the Uniswap V2 sync in the sync_cursor table
+	syncCursorName = "uniswap_v2"
 
 	// used for both pgxpool.Config.MaxConnLifetime and pgxpool.Config.MaxConnIdleTime
 	// TODO: for now set high so conns are open indefinitely
 	pgxMaxConnTime = "876000h" // 100 years
 
-	pgxMaxConns = 6
-
-	//
-	// Performance Tuning
-	//
-	pollingCycle = 300 * time.Second
-	queryBlockCount = 32
-	queryTimeout = 240 * time.Second
-	syncWorkers = 1
+	// bounds of the adaptive FilterLogs window, see rangeSizer
+	queryBlockCountMin = 1
+	queryBlockCountMax = 4096
+	// the window grows while queries return fewer logs than a quarter of this
+	queryLogsTarget = 10000
+	// exponential backoff between retries of failed queries
+	queryBackoffMin = 1 * time.Second
+	queryBackoffMax = 120 * time.Second
+	// failed FilterLogs attempts before the error is returned
+	queryRetries = 8
+	// headers fetched per batch RPC request, see getHeaders
+	headerBatchSize = 100
+	// transactions fetched with their receipts per batch RPC request, see
+	// getTransactions
+	txBatchSize = 50
+
+	// time given to the range being committed to finish after shutdown
+	// was requested, before its DB calls are cancelled as well
+	shutdownTimeout = 30 * time.Second
 )
 
 func InitLog() {
@@ -77,234 +85,860 @@ func InitLog() {
 		log.LvlFilterHandler(log.LvlInfo, log.StreamHandler(os.Stderr, log.TerminalFormat(true)))))
 }
 
-func SyncETH() {
+// SyncETH syncs and then follows the chain until ctx is cancelled. On
+// cancellation no new ranges are fetched, the range being committed is
+// finished and all connections are closed before SyncETH returns nil.
+// Transient RPC and DB errors are retried, other errors are returned.
+func SyncETH(ctx context.Context, cfg *Config) error {
+	if cfg.PprofAddr != "" {
+		go func() {
+			err := http.ListenAndServe(cfg.PprofAddr, nil)
+			if err != nil {
+				log.Error("http.ListenAndServe", "err", err)
+			}
+		}()
+	}
+
+	// DB calls outlive ctx by up to shutdownTimeout, so that an in-flight
+	// range can still be committed.
+	dbCtx, dbCancel := context.WithCancel(context.Background())
+	defer dbCancel()
 	go func() {
-		err := http.ListenAndServe("localhost:6060", nil)
-		if err != nil {
-			log.Error("http.ListenAndServe", "err", err)
+		select {
+		case <-ctx.Done():
+			select {
+			case <-time.After(shutdownTimeout):
+				dbCancel()
+			case <-dbCtx.Done():
+			}
+		case <-dbCtx.Done():
 		}
 	}()
 
-	initDBPool()
+	release, err := acquireDBPool(dbCtx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = MigrateUp(dbCtx, cfg)
+	if err != nil {
+		return err
+	}
+
+	rc, err := getRPCClient(ctx, cfg.Endpoint)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dbConn, err := getDBConn(dbCtx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Release()
+
+	us, err := newUniswapSync(ctx, dbCtx, cfg, rc, dbConn)
+	if err != nil {
+		return err
+	}
+	err = us.follow()
+	if err != nil {
+		return err
+	}
+	log.Info("sync stopped", "fromBlock", us.fromBlock)
+	return nil
+}
 
-	syncUniswap()
+// uniswapSync holds the state of the Uniswap V2 sync between catch-ups:
+// the address set of the factory and all known pairs, and the next block
+// to be synced.
+type uniswapSync struct {
+	// ctx is cancelled on shutdown and used for RPC calls, dbCtx outlives
+	// it by shutdownTimeout and is used for DB calls
+	ctx context.Context
+	dbCtx context.Context
+
+	cfg *Config
+	// rc is the client of ec, used for batch requests
+	rc *rpc.Client
+	ec *ethclient.Client
+	dbConn *pgxpool.Conn
+
+	usf *GlueUSV2Factory
+	usfAddr common.Address
+	usfCreateBlock uint64
+
+	reg *Registry
+	// registry contracts with an address still to be backfilled
+	backfills []*ContractSpec
+
+	// addrs is appended to by the committing goroutine and read by the
+	// sync workers, guarded by mu
+	mu sync.RWMutex
+	addrs []common.Address
+	csm map[common.Address]ContractSync
+
+	fromBlock uint64
+	sizer *rangeSizer
 }
 
-func syncUniswap() {
-	ec := getETHClient()
-	dbConn := getDBConn()
-	usf := NewGlueUSV2Factory()
+func newUniswapSync(ctx, dbCtx context.Context, cfg *Config, rc *rpc.Client, dbConn *pgxpool.Conn) (*uniswapSync, error) {
+	overrides, err := LoadTokenOverrides(cfg.TokenOverrides)
+	if err != nil {
+		return nil, err
+	}
+	usf, err := NewGlueUSV2Factory(NewTokenRegistry(overrides))
+	if err != nil {
+		return nil, err
+	}
 	usfAddr, usfCreateBlock, _ := usf.Contract()
+	reg, err := LoadRegistry(cfg.ContractsDir, cfg.ABIDir)
+	if err != nil {
+		return nil, err
+	}
+	err = reg.createTables(dbCtx, dbConn)
+	if err != nil {
+		return nil, err
+	}
 
-	addrs := []common.Address{usfAddr}
-	csm := make(map[common.Address]ContractSync)
-	csm[usfAddr] = usf
+	s := &uniswapSync{
+		ctx: ctx,
+		dbCtx: dbCtx,
+		cfg: cfg,
+		rc: rc,
+		ec: ethclient.NewClient(rc),
+		dbConn: dbConn,
+		usf: usf,
+		usfAddr: usfAddr,
+		usfCreateBlock: usfCreateBlock,
+		reg: reg,
+		sizer: newRangeSizer(cfg.QueryBlockCount),
+	}
+	err = s.loadPairs()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadPairs (re)initializes the address set from the pairs in us_factory
+// and the contract registry, and sets fromBlock to the block after the
+// sync cursor.
+func (s *uniswapSync) loadPairs() error {
+	addrs := []common.Address{s.usfAddr}
+	s.csm = make(map[common.Address]ContractSync)
+	s.csm[s.usfAddr] = s.usf
 
-	q := "SELECT * FROM us_factory ORDER BY block DESC"
-	pairs := dbQueryPairsCreated(dbConn, q, []interface{}{})
+	q := "SELECT label, block, tx_hash, token0, token1, pair_addr, pair_id FROM us_factory ORDER BY block DESC"
+	pairs, err := dbQueryPairsCreated(s.dbCtx, s.dbConn, q, []interface{}{})
+	if err != nil {
+		return err
+	}
 
 	for _, p := range pairs {
 		addr := common.HexToAddress(p.pair_addr)
 		addrs = append(addrs, addr)
-		cs := NewGlueUSV2Pair(addr, p.block, p.ticker)
-		csm[addr] = cs
+		cs, err := NewGlueUSV2Pair(addr, p.block, p.pair_id)
+		if err != nil {
+			return err
+		}
+		s.csm[addr] = cs
 	}
 
-	fromBlock := usfCreateBlock
-	if len(pairs) > 0 {
-		fromBlock = pairs[0].block
+	cursor, ok, err := dbQuerySyncCursor(s.dbCtx, s.dbConn, syncCursorName)
+	if err != nil {
+		return err
+	}
+	s.fromBlock = 0
+	if ok {
+		s.fromBlock = cursor + 1
+	} else if len(pairs) > 0 {
+		// databases synced before the cursor existed
+		s.fromBlock = pairs[0].block
+	}
+	if s.fromBlock < s.usfCreateBlock {
+		s.fromBlock = s.usfCreateBlock
+	}
+
+	children, err := s.reg.loadChildren(s.dbCtx, s.dbConn)
+	if err != nil {
+		return err
+	}
+	for _, cs := range children {
+		addr, _, _ := cs.Contract()
+		addrs = append(addrs, addr)
+		s.csm[addr] = cs
+	}
+	s.backfills = nil
+	for _, spec := range s.reg.specs {
+		if spec.Address == "" {
+			continue
+		}
+		cursor, ok, err := dbQuerySyncCursor(s.dbCtx, s.dbConn, spec.cursorName())
+		if err != nil {
+			return err
+		}
+		if !ok || cursor+1 < s.fromBlock {
+			s.backfills = append(s.backfills, spec)
+			continue
+		}
+		cs := s.reg.newContract(spec, common.HexToAddress(spec.Address), spec.StartBlock)
+		addrs = append(addrs, common.HexToAddress(spec.Address))
+		s.csm[common.HexToAddress(spec.Address)] = cs
 	}
 
-	headBlock, _ := getHeadBlockAndTime(ec)
-	maxBlock := headBlock - blockConfirmations
+	s.mu.Lock()
+	s.addrs = addrs
+	s.mu.Unlock()
+
+	log.Info("loaded pairs", "pairs", len(pairs), "contracts", len(children)+len(s.reg.specs)-len(s.backfills), "fromBlock", s.fromBlock)
+	return nil
+}
 
-	if fromBlock > maxBlock {
-		log.Info("up-to-date before sync", "fromBlock", fromBlock, "headBlock", headBlock, "pairs", len(pairs))
-		return
+// follow catches up with the chain and then keeps ingesting new confirmed
+// blocks until s.ctx is cancelled. A sync is triggered by every new head
+// received over the websocket subscription, and at least once every
+// cfg.PollingCycle in case the subscription stalls or fails. A failed
+// subscription is renewed with a backoff.
+//
+// Retryable errors are logged and the sync is resumed from the sync cursor
+// after a backoff; other errors stop the sync and are returned.
+func (s *uniswapSync) follow() error {
+	heads := make(chan *types.Header, 16)
+	var sub ethereum.Subscription
+	var subErr <-chan error
+	var resub <-chan time.Time
+	subBackoff := queryBackoffMin
+	retrySub := func() {
+		resub = time.After(subBackoff)
+		subBackoff *= 2
+		if subBackoff > queryBackoffMax {
+			subBackoff = queryBackoffMax
+		}
 	}
+	subscribe := func() {
+		var err error
+		sub, err = s.ec.SubscribeNewHead(s.ctx, heads)
+		if errors.Is(err, rpc.ErrNotificationsUnsupported) {
+			log.Warn("ethclient.SubscribeNewHead, polling", "err", err)
+			return
+		}
+		if err != nil {
+			log.Warn("ethclient.SubscribeNewHead, polling until resubscribed", "err", err, "backoff", subBackoff)
+			sub = nil
+			retrySub()
+			return
+		}
+		subErr = sub.Err()
+		subBackoff = queryBackoffMin
+	}
+	subscribe()
+	defer func() {
+		if sub != nil {
+			sub.Unsubscribe()
+		}
+	}()
 
-	log.Info("syncing", "fromBlock", fromBlock, "maxBlock", maxBlock, "pairs", len(pairs))
+	confirmations := s.cfg.BlockConfirmations
+	if s.cfg.LowLatency {
+		confirmations = 0
+	}
 
-	getLogs := func(fb, tb uint64, as []common.Address) ([]types.Log, time.Duration) {
-		fq := ethereum.FilterQuery{
-			FromBlock: new(big.Int).SetUint64(fb),
-			ToBlock: new(big.Int).SetUint64(tb),
-			Addresses: as}
-		t0 := time.Now()
-		logs, err := ec.FilterLogs(context.Background(), fq)
+	backoff := queryBackoffMin
+	for s.ctx.Err() == nil {
+		err := s.step(confirmations)
 		if err != nil {
-			log.Error("ethclient.FilterLogs", "err", err)
-			panic(err)
+			if s.ctx.Err() != nil {
+				break
+			}
+			if !IsRetryable(err) {
+				return err
+			}
+			log.Warn("sync failed, retrying", "err", err, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return nil
+			}
+			backoff *= 2
+			if backoff > queryBackoffMax {
+				backoff = queryBackoffMax
+			}
+			err = s.loadPairs()
+			if err != nil && !IsRetryable(err) {
+				return err
+			}
+			continue
+		}
+		backoff = queryBackoffMin
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-heads:
+		case <-time.After(s.cfg.PollingCycle):
+		case err := <-subErr:
+			log.Warn("newHeads subscription failed, polling until resubscribed", "err", err, "backoff", subBackoff)
+			sub.Unsubscribe()
+			sub, subErr = nil, nil
+			retrySub()
+		case <-resub:
+			resub = nil
+			subscribe()
+		}
+		// drain heads that arrived while syncing
+		for len(heads) > 0 {
+			<-heads
 		}
-		return logs, time.Since(t0)
 	}
+	return nil
+}
 
-	var toBlock uint64
-	for {
-		toBlock = fromBlock + queryBlockCount
-		if toBlock > maxBlock {
-			toBlock = maxBlock
+// step checks for reorgs in low latency mode and syncs up to the head minus
+// confirmations, again right away if the chain changed during the sync.
+func (s *uniswapSync) step(confirmations uint64) error {
+	for s.ctx.Err() == nil {
+		if s.cfg.LowLatency {
+			err := s.checkReorg()
+			if err != nil {
+				return err
+			}
+		}
+		err := s.backfill()
+		if err != nil || len(s.backfills) > 0 {
+			return err
+		}
+		headBlock, _, err := getHeadBlockAndTime(s.ctx, s.ec)
+		if err != nil {
+			return err
+		}
+		if headBlock < confirmations {
+			return nil
 		}
+		ok, err := s.syncTo(headBlock - confirmations)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return nil
+}
 
-		logs, t1 := getLogs(fromBlock, toBlock, addrs)
-		t2 := time.Now()
-		fLogs := []types.Log{}
-		for _, l := range logs {
-			if l.Address == usfAddr {
-				fLogs = append(fLogs, l)
-			} else {
-				// Insert all pair logs
-				cs := csm[l.Address]
-				args := parseLog(l, cs)
-				cs.Insert(dbConn, ec, l, args)
+// fetchedRange holds the logs of a block range fetched by a sync worker for
+// the first nAddrs addresses of the address set.
+type fetchedRange struct {
+	fromBlock, toBlock uint64
+	logs []types.Log
+	nAddrs int
+	t time.Duration
+	// headers of the blocks of logs, if they could be fetched
+	headers map[uint64]*blockHeader
+}
+
+// syncTo ingests all logs of the factory and known pairs from s.fromBlock up
+// to and including maxBlock.
+//
+// Logs are fetched by cfg.SyncWorkers concurrent workers over consecutive
+// windows, but ranges are committed strictly in block order. Pairs created
+// in a range are only known once it is committed, so when a later window was
+// fetched with a smaller address set, the logs of the missing addresses are
+// fetched before it is committed. This keeps the factory-logs-last guarantee
+// of syncRange intact.
+//
+// The first worker error cancels the other workers and is returned. syncTo
+// returns false if the chain changed during the sync; the pairs are reloaded
+// and nothing past the last committed range was written.
+func (s *uniswapSync) syncTo(maxBlock uint64) (bool, error) {
+	if s.fromBlock > maxBlock {
+		return true, nil
+	}
+
+	log.Info("syncing", "fromBlock", s.fromBlock, "maxBlock", maxBlock, "addrs", len(s.addrs), "workers", s.cfg.SyncWorkers)
+
+	workers := s.cfg.SyncWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// at most inFlight windows are fetched but not yet committed
+	inFlight := 2 * workers
+	tokens := make(chan struct{}, inFlight)
+	jobs := make(chan [2]uint64)
+	results := make(chan *fetchedRange, inFlight)
+	quit := make(chan struct{})
+
+	// ctx is cancelled on the first worker error, which is then in werr
+	ctx, cancel := context.WithCancel(s.ctx)
+	var werr error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			werr = err
+			cancel()
+		})
+	}
+	stopped := func() error {
+		if s.ctx.Err() != nil {
+			return nil
+		}
+		return werr
+	}
+
+	start := s.fromBlock
+	go func() {
+		defer close(jobs)
+		for fb := start; fb <= maxBlock; {
+			tb := fb + s.sizer.window() - 1
+			if tb > maxBlock {
+				tb = maxBlock
 			}
+			select {
+			case tokens <- struct{}{}:
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- [2]uint64{fb, tb}:
+			case <-quit:
+				return
+			}
+			fb = tb + 1
 		}
-		t3 := time.Since(t2)
+	}()
 
-		log.Info("sync", "fromBlock", fromBlock, "left", maxBlock-fromBlock, "addrs", len(addrs), "logs", len(logs), "fl", t1, "in", t3)
-
-		// If we have factory logs, parse out new pair addresses,
-		// get their logs and insert them.
-		if len(fLogs) > 0 {
-			npAddrs := []common.Address{}
-			for _, fl := range fLogs {
-				args := parseLog(fl, usf)
-				t0, t1, a := args[2].(string), args[3].(string), args[4].(string)
-				pa := common.HexToAddress(a)
-				ticker := getTicker(dbConn, ec, t0, t1)
-				cs := NewGlueUSV2Pair(pa, fl.BlockNumber, ticker)
-				csm[pa] = cs
-				npAddrs = append(npAddrs, pa)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				s.mu.RLock()
+				as := s.addrs[:len(s.addrs):len(s.addrs)]
+				s.mu.RUnlock()
+
+				logs, t, err := s.getLogs(ctx, j[0], j[1], as)
+				if ctx.Err() != nil {
+					// shutting down or another worker failed
+					return
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+				// on error syncRange fetches the headers again
+				headers, _ := getHeaders(ctx, s.rc, logBlocks(logs))
+				results <- &fetchedRange{j[0], j[1], logs, len(as), t, headers}
 			}
-			addrs = append(addrs, npAddrs...)
-
-			pLogs, t4 := getLogs(fromBlock, toBlock, npAddrs)
-			t5 := time.Now()
-			for _, l := range pLogs {
-				cs := csm[l.Address]
-				args := parseLog(l, cs)
-				cs.Insert(dbConn, ec, l, args)
+		}()
+	}
+	defer func() {
+		cancel()
+		close(quit)
+		wg.Wait()
+	}()
+
+	pending := make(map[uint64]*fetchedRange)
+	for s.fromBlock <= maxBlock {
+		if ctx.Err() != nil {
+			return true, stopped()
+		}
+		r, ok := pending[s.fromBlock]
+		if !ok {
+			select {
+			case r = <-results:
+				pending[r.fromBlock] = r
+			case <-ctx.Done():
 			}
-			t6 := time.Since(t5)
-
-			log.Info("re-sync new pairs", "fromBlock", fromBlock, "newPairs", len(npAddrs), "fl", t4, "in", t6)
-			// Insert factory logs last, so that if committed to DB we
-			// know that all pair logs in the block range are also committed.
-			// This can be safely used to initialize the address set
-			// on arbitrary sync restarts.
-			for _, l := range fLogs {
-				args := parseLog(l, usf)
-				usf.Insert(dbConn, ec, l, args)
+			continue
+		}
+		delete(pending, s.fromBlock)
+
+		if len(s.addrs) > r.nAddrs {
+			logs, t, err := s.getLogs(ctx, r.fromBlock, r.toBlock, s.addrs[r.nAddrs:])
+			if ctx.Err() != nil {
+				return true, stopped()
+			}
+			if err != nil {
+				return true, err
 			}
+			r.logs = append(r.logs, logs...)
+			sort.SliceStable(r.logs, func(i, j int) bool {
+				if r.logs[i].BlockNumber != r.logs[j].BlockNumber {
+					return r.logs[i].BlockNumber < r.logs[j].BlockNumber
+				}
+				return r.logs[i].Index < r.logs[j].Index
+			})
+			r.t += t
 		}
 
-		fromBlock = fromBlock + queryBlockCount + 1
-		if fromBlock > maxBlock {
-			log.Info("up-to-date after sync", "fromBlock", fromBlock, "headBlock", headBlock)
-			return
+		ok, err := s.syncRange(r, maxBlock)
+		if err != nil {
+			return true, err
 		}
+		if !ok {
+			// The chain changed while we were fetching this range, or
+			// we are shutting down; nothing was committed.
+			return false, s.loadPairs()
+		}
+		<-tokens
+
+		s.fromBlock = r.toBlock + 1
 	}
+	log.Info("up-to-date after sync", "fromBlock", s.fromBlock, "maxBlock", maxBlock)
+	return true, nil
 }
 
-func parseLog(l types.Log, cs ContractSync) []interface{} {
-	_, _, cABI := cs.Contract()
-	eventName := cs.EventName(l.Topics)
-	tn, dnt := cs.LogFields(eventName)
+func (s *uniswapSync) getLogs(ctx context.Context, fb, tb uint64, as []common.Address) ([]types.Log, time.Duration, error) {
+	t0 := time.Now()
+	logs, err := s.filterLogs(ctx, fb, tb, as)
+	return logs, time.Since(t0), err
+}
 
-	args := make([]interface{}, 0)
-	args = append(args, l.BlockNumber, l.TxHash.Hex())
+// filterLogs fetches the logs of [fb, tb]. If the node rejects the query
+// because of its result limit or the query times out, the range is split
+// in halves and the window shrunk. Other errors are retried with exponential backoff up to
+// queryRetries times and then returned as ErrRPC; the error of ctx is
+// returned once it is cancelled.
+func (s *uniswapSync) filterLogs(ctx context.Context, fb, tb uint64, as []common.Address) ([]types.Log, error) {
+	fq := ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fb),
+		ToBlock: new(big.Int).SetUint64(tb),
+		Addresses: as}
+
+	backoff := queryBackoffMin
+	for retry := 0; ; retry++ {
+		qctx, cancel := context.WithTimeout(ctx, s.cfg.QueryTimeout)
+		logs, err := s.ec.FilterLogs(qctx, fq)
+		timedOut := qctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			s.sizer.observe(tb-fb+1, len(logs))
+			return logs, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// a node without result limit, like geth, times out instead
+		if (timedOut || isQueryLimitErr(err)) && tb > fb {
+			s.sizer.shrink(tb-fb+1)
+			mid := fb + (tb-fb)/2
+			log.Warn("ethclient.FilterLogs, splitting range", "err", err, "fromBlock", fb, "toBlock", tb)
+			logs0, err := s.filterLogs(ctx, fb, mid, as)
+			if err != nil {
+				return nil, err
+			}
+			logs1, err := s.filterLogs(ctx, mid+1, tb, as)
+			if err != nil {
+				return nil, err
+			}
+			return append(logs0, logs1...), nil
+		}
+		if retry == queryRetries {
+			return nil, rpcError("ethclient.FilterLogs", err)
+		}
 
-	for i, _ := range tn {
-		addr := common.HexToAddress(l.Topics[i+1].Hex())
-		args = append(args, addr.Hex())
+		log.Warn("ethclient.FilterLogs, retrying", "err", err, "fromBlock", fb, "toBlock", tb, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > queryBackoffMax {
+			backoff = queryBackoffMax
+		}
 	}
+}
 
-	m := make(map[string]interface{})
-	err := cABI.UnpackIntoMap(m, eventName, l.Data)
-	if err != nil {
-		log.Error("ABI.Unpack", "err", err, "en", eventName, "l", l, "abi", cABI)
-		panic(err)
+// queryLimitCode is the JSON-RPC error code of a query over the result
+// limit of the node, see EIP-1474.
+const queryLimitCode = -32005
+
+// queryLimitMsgs are the messages of nodes and providers that reject a
+// query over their result limit.
+var queryLimitMsgs = []string{
+	"query returned more than",
+	"response size exceeded",
+	"response size should not greater than",
+	"query exceeds max results",
+}
+
+// isQueryLimitErr reports whether err means that the query covered too many
+// logs: the node rejected it over its result limit or it timed out, as
+// opposed to the node being unavailable.
+func isQueryLimitErr(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == queryLimitCode {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range queryLimitMsgs {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeSizer adapts the number of blocks per FilterLogs query to the
+// density of logs: it doubles the window while queries return few logs and
+// halves it when a query hits a node limit.
+type rangeSizer struct {
+	mu sync.Mutex
+	size uint64
+}
 
-	// TODO: use types / direct decoding from ABI
-	i := 0
-	for i < len(dnt) {
-		switch dnt[i+1] {
-		case "address":
-			a := m[dnt[i]].(common.Address)
-			args = append(args, a.Hex())
-		case "smalluint":
-			b := m[dnt[i]].(*big.Int)
-			args = append(args, b.Uint64())
-		case "biguint":
-			b := m[dnt[i]].(*big.Int)
-			args = append(args, b.String())
+func newRangeSizer(size uint64) *rangeSizer {
+	if size < queryBlockCountMin {
+		size = queryBlockCountMin
+	}
+	if size > queryBlockCountMax {
+		size = queryBlockCountMax
+	}
+	return &rangeSizer{size: size}
+}
+
+func (r *rangeSizer) window() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+func (r *rangeSizer) observe(blocks uint64, logs int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if blocks >= r.size && logs < queryLogsTarget/4 && r.size < queryBlockCountMax {
+		r.size *= 2
+		if r.size > queryBlockCountMax {
+			r.size = queryBlockCountMax
 		}
-		i += 2
 	}
+}
 
-	return args
+func (r *rangeSizer) shrink(blocks uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if blocks/2 < r.size {
+		r.size = blocks / 2
+	}
+	if r.size < queryBlockCountMin {
+		r.size = queryBlockCountMin
+	}
 }
 
-func getDBConn() *pgxpool.Conn {
-	dbConn, err := dbPool.Acquire(context.Background())
+// syncRange writes all logs in the fetched range and advances the sync
+// cursor in a single transaction, so that a restart resumes exactly after
+// the last fully committed range. It returns false if the range was
+// discarded because of a reorg or shutdown.
+func (s *uniswapSync) syncRange(r *fetchedRange, maxBlock uint64) (bool, error) {
+	fromBlock, toBlock := r.fromBlock, r.toBlock
+
+	ctx := s.dbCtx
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return false, dbError("dbConn.Begin", err)
+	}
+	defer tx.Rollback(ctx)
+	w := newDBWriter(ctx, tx, s.cfg.CopyFlushSize)
+
+	logs, ok, err := s.ingest(w, fromBlock, toBlock, r.logs, r.t, maxBlock)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = w.flush()
+	if err != nil {
+		return false, err
+	}
+
+	headers, ok, err := s.logHeaders(r.headers, logs)
+	if err != nil || !ok {
+		return false, err
+	}
+	if s.cfg.LowLatency {
+		ok, err := s.linkHeaders(tx, fromBlock, toBlock, maxBlock, headers)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	err = dbUpsertBlocks(ctx, tx, headers)
+	if err != nil {
+		return false, err
+	}
+	err = s.enrichTxs(tx, logs)
+	if err != nil {
+		return false, err
+	}
+	err = dbBuildCandles(ctx, tx, fromBlock, toBlock)
 	if err != nil {
-		log.Error("dbPool.Acquire", "err", err)
-		panic(err)
+		return false, err
 	}
-	return dbConn
+	err = dbBuildLPBalances(ctx, tx, fromBlock, toBlock)
+	if err != nil {
+		return false, err
+	}
+
+	err = dbSetSyncCursor(ctx, tx, syncCursorName, toBlock)
+	if err != nil {
+		return false, err
+	}
+	// all registry contracts not in s.backfills are synced with the rest
+	q := "UPDATE sync_cursor SET block = $1, updated_at = now() WHERE left(name, length($2)) = $2"
+	err = dbExec(ctx, tx, q, []interface{}{toBlock, registryCursorPrefix})
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, dbError("tx.Commit", err)
+	}
+	return true, nil
+}
+
+// ingest inserts the logs of [fromBlock, toBlock].
+//
+// Logs of contract factories (the Uniswap V2 factory and registry contracts
+// with factory-discovered children) can create new contracts; their logs
+// in the range are fetched and ingested in turn, and factory logs are
+// inserted last, so that if committed to DB we know that all logs of the
+// created contracts in the block range are also committed. This can be
+// safely used to initialize the address set on arbitrary sync restarts.
+//
+// It returns all ingested logs, or false if fetching was interrupted.
+func (s *uniswapSync) ingest(w *dbWriter, fromBlock, toBlock uint64, logs []types.Log, t1 time.Duration, maxBlock uint64) ([]types.Log, bool, error) {
+	all := logs
+	fLogs := []types.Log{}
+	for round := 0; len(logs) > 0; round++ {
+		t2 := time.Now()
+		created := []ContractSync{}
+		for _, l := range logs {
+			cs := s.csm[l.Address]
+			f, ok := cs.(contractFactory)
+			if !ok {
+				err := s.insertLog(w, l, cs)
+				if err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			d, err := parseLog(l, cs)
+			if errors.Is(err, ErrUnknownEvent) {
+				skipLog(l, cs, err)
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			ncs, err := f.Discover(l, d)
+			if err != nil {
+				return nil, false, err
+			}
+			created = append(created, ncs...)
+			fLogs = append(fLogs, l)
+		}
+		t3 := time.Since(t2)
+
+		if round == 0 {
+			log.Info("sync", "fromBlock", fromBlock, "left", maxBlock-fromBlock, "addrs", len(s.addrs), "logs", len(logs), "fl", t1, "in", t3)
+		} else {
+			log.Info("re-sync new contracts", "fromBlock", fromBlock, "round", round, "logs", len(logs), "fl", t1, "in", t3)
+		}
+		if len(created) == 0 {
+			break
+		}
+
+		// get the logs of the new contracts
+		ncAddrs := []common.Address{}
+		for _, cs := range created {
+			a, _, _ := cs.Contract()
+			if _, ok := s.csm[a]; ok {
+				continue
+			}
+			s.csm[a] = cs
+			ncAddrs = append(ncAddrs, a)
+		}
+		if len(ncAddrs) == 0 {
+			// an empty address set would match all logs
+			break
+		}
+		s.mu.Lock()
+		s.addrs = append(s.addrs, ncAddrs...)
+		s.mu.Unlock()
+
+		var err error
+		logs, t1, err = s.getLogs(s.ctx, fromBlock, toBlock, ncAddrs)
+		if s.ctx.Err() != nil {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		all = append(all, logs...)
+	}
+
+	for _, l := range fLogs {
+		err := s.insertLog(w, l, s.csm[l.Address])
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return all, true, nil
 }
 
-func getETHClient() *ethclient.Client {
-	c, err := ethclient.Dial(endpoint)
+func (s *uniswapSync) insertLog(w *dbWriter, l types.Log, cs ContractSync) error {
+	d, err := parseLog(l, cs)
+	if errors.Is(err, ErrUnknownEvent) {
+		skipLog(l, cs, err)
+		return nil
+	}
 	if err != nil {
-     	log.Error("rpc.Dial", "err", err)
-		panic(err)
+		return err
 	}
-	return c
+	return cs.Insert(w, s.ec, l, d)
 }
 
-func getHeadBlockAndTime(c *ethclient.Client) (uint64, time.Time) {
-	lastHeader, err := c.HeaderByNumber(context.Background(), nil)
+// skippedLogs counts logs whose topic matches no event of the contract
+// ABI, such as anonymous events, published at /debug/vars.
+var skippedLogs = expvar.NewInt("kanot_skipped_logs")
+
+func skipLog(l types.Log, cs ContractSync, err error) {
+	skippedLogs.Add(1)
+	log.Debug("skipping log of unknown event", "contract", cs.Name(), "block", l.BlockNumber, "index", l.Index, "err", err)
+}
+
+func getDBConn(ctx context.Context) (*pgxpool.Conn, error) {
+	dbConn, err := dbPool.Acquire(ctx)
 	if err != nil {
-		log.Error("client.HeaderByNumber", "err", err)
-		panic(err)
+		return nil, dbError("dbPool.Acquire", err)
 	}
+	return dbConn, nil
+}
 
-	headBlock := lastHeader.Number.Uint64()
-	t := time.Unix(int64(lastHeader.Time), 0)
-	return headBlock, t
+func getRPCClient(ctx context.Context, endpoint string) (*rpc.Client, error) {
+	c, err := rpc.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, rpcError("rpc.Dial", err)
+	}
+	return c, nil
 }
 
-func getSymbol(ec *ethclient.Client, addr string) string {
-	// Use the USV2Pair ABI as it has the standard ERC-20 Symbol function
-	c0, err := NewUSV2Pair(common.HexToAddress(addr), ec)
+func getHeadBlockAndTime(ctx context.Context, c *ethclient.Client) (uint64, time.Time, error) {
+	lastHeader, err := c.HeaderByNumber(ctx, nil)
 	if err != nil {
-		log.Error("NewUSV2Pair", "err", err)
-		panic(err)
+		return 0, time.Time{}, rpcError("client.HeaderByNumber", err)
 	}
 
-	symbol, err := c0.Symbol(nil)
+	headBlock := lastHeader.Number.Uint64()
+	t := time.Unix(int64(lastHeader.Time), 0)
+	return headBlock, t, nil
+}
+
+func getHeader(ctx context.Context, c *ethclient.Client, n uint64) (*types.Header, error) {
+	h, err := c.HeaderByNumber(ctx, new(big.Int).SetUint64(n))
 	if err != nil {
-		// Try DSToken (MKR et al)
-		c1, err0 := NewDSToken(common.HexToAddress(addr), ec)
-		if err0 != nil {
-			log.Error("NewDSToken", "err", err0)
-			panic(err0)
-		}
-
-		symbol, err1 := c1.Symbol(nil)
-		if err1 != nil {
-			switch addr {
-			case "0xE0B7927c4aF23765Cb51314A0E0521A9645F0E2A":
-				return "DGD" // fucking digix
-			}
-			log.Warn("c1.Symbol()", "err", err1, "addr", addr)
-			// fuck it, use first 3 hex digits...
-			return addr[:3]
-		}
-		//log.Info("FFS", "symbol", symbol)
-		return strings.Trim(string(symbol[:]), string([]byte{0}))
+		return nil, rpcError("client.HeaderByNumber", err)
 	}
-	return symbol
+	return h, nil
 }
@@ -0,0 +1,114 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// codeError is a JSON-RPC error response.
+type codeError struct {
+	code int
+	msg string
+}
+
+func (e *codeError) Error() string { return e.msg }
+func (e *codeError) ErrorCode() int { return e.code }
+
+func TestIsQueryLimitErr(t *testing.T) {
+	tests := []struct {
+		err error
+		want bool
+	}{
+		{errors.New("query returned more than 10000 results"), true},
+		{errors.New("Log response size exceeded. You can make eth_getLogs requests with up to a 2K block range"), true},
+		{errors.New("response size should not greater than 10000000 bytes"), true},
+		{errors.New("query exceeds max results 20000, retry with the range 100-200"), true},
+		{&codeError{-32005, "limit exceeded"}, true},
+		{fmt.Errorf("filter: %w", &codeError{-32005, "backend busy"}), true},
+
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("post: %w", context.DeadlineExceeded), true},
+		{errors.New("read tcp 127.0.0.1:13516: i/o timeout"), false},
+		{errors.New("request timed out"), false},
+		{errors.New("dial tcp 127.0.0.1:13516: connect: connection refused"), false},
+		{errors.New("429 Too Many Requests"), false},
+		{errors.New("EOF"), false},
+		{&codeError{-32000, "header not found"}, false},
+	}
+	for _, tt := range tests {
+		got := isQueryLimitErr(tt.err)
+		if got != tt.want {
+			t.Errorf("isQueryLimitErr(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRangeSizer(t *testing.T) {
+	if w := newRangeSizer(0).window(); w != queryBlockCountMin {
+		t.Errorf("newRangeSizer(0) window %d, want %d", w, queryBlockCountMin)
+	}
+	if w := newRangeSizer(queryBlockCountMax * 2).window(); w != queryBlockCountMax {
+		t.Errorf("newRangeSizer(%d) window %d, want %d", queryBlockCountMax*2, w, queryBlockCountMax)
+	}
+
+	r := newRangeSizer(32)
+	steps := []struct {
+		op string
+		blocks uint64
+		logs int
+		want uint64
+	}{
+		// few logs over a full window grow it
+		{"observe", 32, 10, 64},
+		{"observe", 64, queryLogsTarget/4 - 1, 128},
+		// a partial window at the end of the range does not
+		{"observe", 100, 0, 128},
+		// nor do many logs
+		{"observe", 128, queryLogsTarget / 4, 128},
+		// a limit error halves the failed range
+		{"shrink", 128, 0, 64},
+		// a failed range larger than the window leaves it
+		{"shrink", 256, 0, 64},
+		{"shrink", 2, 0, 1},
+		{"shrink", 1, 0, queryBlockCountMin},
+		{"observe", 1, 0, 2},
+	}
+	for i, st := range steps {
+		switch st.op {
+		case "observe":
+			r.observe(st.blocks, st.logs)
+		case "shrink":
+			r.shrink(st.blocks)
+		}
+		if w := r.window(); w != st.want {
+			t.Errorf("step %d: %s(%d, %d) window %d, want %d", i, st.op, st.blocks, st.logs, w, st.want)
+		}
+	}
+
+	r = newRangeSizer(queryBlockCountMax)
+	r.observe(queryBlockCountMax, 0)
+	if w := r.window(); w != queryBlockCountMax {
+		t.Errorf("window grew past max to %d", w)
+	}
+}
@@ -19,28 +19,42 @@
 package kanot
 
 import (
+	"context"
 	"strings"
 	"strconv"
-	//"math/big"
+	"sync"
+	"math/big"
 
-	"github.com/jackc/pgx/v4/pgxpool"
-
-	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 type ContractSync interface {
 	Name() string
 	Contract() (common.Address, uint64, *abi.ABI)
 
-	EventName([]common.Hash) string
-	LogFields(string) ([]string, []string)
+	EventName([]common.Hash) (string, error)
+
+	LastInsertedBlock(context.Context, dbQuerier) (uint64, error)
+	Insert(*dbWriter, *ethclient.Client, types.Log, *decodedLog) error
+}
+
+// logColumns identify the log of a row, they are written for every event
+// before its arguments. (block, log_index) is unique in every event table.
+var logColumns = []string{"block", "tx_hash", "tx_index", "log_index", "block_hash"}
+
+func logValues(l types.Log) []interface{} {
+	return []interface{}{l.BlockNumber, l.TxHash.Hex(), l.TxIndex, l.Index, l.BlockHash.Hex()}
+}
 
-	LastInsertedBlock(*pgxpool.Conn) uint64
-	Insert(*pgxpool.Conn, *ethclient.Client, types.Log, []interface{})
+// contractFactory is implemented by ContractSyncs whose logs create new
+// contracts to sync, like the Uniswap V2 factory creates pairs.
+type contractFactory interface {
+	// Discover returns the contracts created by a log, if any
+	Discover(types.Log, *decodedLog) ([]ContractSync, error)
 }
 
 // https://uniswap.org/docs/v2/smart-contracts/factory/
@@ -48,11 +62,15 @@ type ContractSync interface {
 type GlueUSV2Factory struct {
 	dbTableName string
 	contractABI *abi.ABI
+	tokens *TokenRegistry
 }
 
-func NewGlueUSV2Factory() *GlueUSV2Factory {
-	a := loadABI(uniswapFactoryABI)
-	return &GlueUSV2Factory{"us_factory", &a}
+func NewGlueUSV2Factory(tokens *TokenRegistry) (*GlueUSV2Factory, error) {
+	a, err := loadABI(uniswapFactoryABI)
+	if err != nil {
+		return nil, err
+	}
+	return &GlueUSV2Factory{"us_factory", a, tokens}, nil
 }
 
 func (s *GlueUSV2Factory) Name() string {
@@ -63,160 +81,211 @@ func (s *GlueUSV2Factory) Contract() (common.Address, uint64, *abi.ABI) {
 	return common.HexToAddress(uniswapFactoryAddr), uniswapFactoryCreateBlock, s.contractABI
 }
 
-func (s *GlueUSV2Factory) EventName(topics []common.Hash) string {
-	return "PairCreated"
+func (s *GlueUSV2Factory) EventName(topics []common.Hash) (string, error) {
+	return "PairCreated", nil
+}
+
+func (s *GlueUSV2Factory) LastInsertedBlock(ctx context.Context, dbConn dbQuerier) (uint64, error) {
+	t, err := dbTable(s.dbTableName)
+	if err != nil {
+		return 0, err
+	}
+	q := "SELECT block FROM " + t + " ORDER BY block DESC LIMIT 1"
+	return dbQueryUint64(ctx, dbConn, q, []interface{}{})
+}
+
+func (s *GlueUSV2Factory) Discover(l types.Log, d *decodedLog) ([]ContractSync, error) {
+	pa, pairID := d.raw("pair").(common.Address), d.raw("arg3").(*big.Int).Uint64()
+	cs, err := NewGlueUSV2Pair(pa, l.BlockNumber, pairID)
+	if err != nil {
+		return nil, err
+	}
+	return []ContractSync{cs}, nil
 }
 
-func (s *GlueUSV2Factory) LogFields(eventName string) ([]string, []string) {
-	tn := []string{"token0", "token1"}
-	dnt := []string{"pair", "address", "arg3", "smalluint"}
-	return tn, dnt
+func (s *GlueUSV2Factory) Insert(w *dbWriter, ec *ethclient.Client, l types.Log, d *decodedLog) error {
+	token0, token1 := d.raw("token0").(common.Address), d.raw("token1").(common.Address)
+	label, err := pairLabel(w.ctx, ec, s.tokens, token0, token1)
+	if err != nil {
+		return err
+	}
+	cols := append([]string{"label"}, logColumns...)
+	vals := append([]interface{}{label}, logValues(l)...)
+	for i, c := range d.cols {
+		switch c {
+		case "pair":
+			c = "pair_addr"
+		case "arg3":
+			// index in allPairs plus one, decoded as uint256
+			cols = append(cols, "pair_id")
+			vals = append(vals, d.raws[i].(*big.Int).Uint64())
+			continue
+		}
+		cols = append(cols, c)
+		vals = append(vals, d.vals[i])
+	}
+	return w.insert(s.dbTableName, cols, vals)
 }
 
-func (s *GlueUSV2Factory) LastInsertedBlock(dbConn *pgxpool.Conn) uint64 {
-	q := "SELECT block FROM " + s.dbTableName + " ORDER BY block DESC LIMIT 1"
-	return dbQueryUint64(dbConn, q, []interface{}{})
+// pairLabel returns the human-readable label "SYM0-SYM1" of a pair. Labels
+// are not unique and change with token metadata, pairs are identified by
+// their pair_id, see RelabelPairs.
+func pairLabel(ctx context.Context, ec *ethclient.Client, tokens *TokenRegistry, t0, t1 common.Address) (string, error) {
+	tok0, err := tokens.Get(ctx, ec, t0)
+	if err != nil {
+		return "", err
+	}
+	tok1, err := tokens.Get(ctx, ec, t1)
+	if err != nil {
+		return "", err
+	}
+	return tok0.Symbol + "-" + tok1.Symbol, nil
 }
 
-func (s *GlueUSV2Factory) Insert(dbConn *pgxpool.Conn, ec *ethclient.Client, l types.Log, args []interface{}) {
-	tokenAddr0, tokenAddr1 := args[2].(string), args[3].(string)
-	pairTicker := getTicker(dbConn, ec, tokenAddr0, tokenAddr1)
-	//log.Info("pairTicker duplicate", "new", pairTicker1, "t0", tokenAddr0, "t1", tokenAddr1)
-	q1 := "INSERT INTO " + s.dbTableName + " (pair, block, tx_hash, token0, token1, pair_addr, pair_id) VALUES ('" + pairTicker + "', $1, $2, $3, $4, $5, $6)"
-	dbExec(dbConn, q1, args)
+// RelabelPairs applies the token overrides to the tokens table and sets
+// the label of every pair from the current symbols of its tokens.
+func RelabelPairs(ctx context.Context, cfg *Config) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	overrides, err := LoadTokenOverrides(cfg.TokenOverrides)
+	if err != nil {
+		return err
+	}
+	for addr, o := range overrides {
+		t, err := dbQueryToken(ctx, dbPool, addr)
+		if err != nil {
+			return err
+		}
+		if t != nil && o.apply(t) {
+			err = dbUpsertToken(ctx, dbPool, t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := dbRelabelPairs(ctx, dbPool)
+	if err != nil {
+		return err
+	}
+	log.Info("relabeled pairs", "pairs", n)
+	return nil
 }
 
-func getTicker(dbConn *pgxpool.Conn, ec *ethclient.Client, t0, t1 string) string {
-	pairTicker0 := getSymbol(ec, t0) + "-" + getSymbol(ec, t1)
-	q0 := "SELECT pair FROM us_factory WHERE pair LIKE '" + pairTicker0 + "%'"
-	tickers := dbQueryPairTickers(dbConn, q0)
-	return pairTicker0 + "-" + strconv.Itoa(len(tickers))
+func dbRelabelPairs(ctx context.Context, dbConn dbQuerier) (int64, error) {
+	q := "UPDATE us_factory f SET label = t0.symbol || '-' || t1.symbol " +
+		"FROM tokens t0, tokens t1 " +
+		"WHERE t0.addr = f.token0 AND t1.addr = f.token1 AND f.label <> t0.symbol || '-' || t1.symbol"
+	tag, err := dbConn.Exec(ctx, q)
+	if err != nil {
+		return 0, dbError("dbConn.Exec", err)
+	}
+	return tag.RowsAffected(), nil
 }
 
+// Event tables of GlueUSV2Pair, prefixed with dbTableBase
+var usPairEventTables = []string{"mint", "burn", "swap", "sync", "approval", "transfer"}
+
 // https://uniswap.org/docs/v2/smart-contracts/pair/
 type GlueUSV2Pair struct {
 	contractAddr common.Address
 	contractABI *abi.ABI
 	createBlock uint64
-	pairTicker string
+	// index of the pair in the factory's allPairs plus one, the uint of
+	// PairCreated
+	pairID uint64
 	dbTableBase string
 }
 
-func NewGlueUSV2Pair(addr common.Address, block uint64, ticker string) *GlueUSV2Pair {
-	a := loadABI(uniswapPairABI)
+func NewGlueUSV2Pair(addr common.Address, block uint64, pairID uint64) (*GlueUSV2Pair, error) {
+	a, err := loadABI(uniswapPairABI)
+	if err != nil {
+		return nil, err
+	}
 	return &GlueUSV2Pair{
 		contractAddr: addr,
-		contractABI: &a,
+		contractABI: a,
 		createBlock: block,
-		pairTicker: ticker,
+		pairID: pairID,
 		dbTableBase: "us_pair_",
-	}
+	}, nil
 }
 
 func (s *GlueUSV2Pair) Name() string {
-	return "USV2Pair_" + s.pairTicker
+	return "USV2Pair_" + strconv.FormatUint(s.pairID, 10)
 }
 
 func (s *GlueUSV2Pair) Contract() (common.Address, uint64, *abi.ABI) {
 	return s.contractAddr, s.createBlock, s.contractABI
 }
 
-func (s *GlueUSV2Pair) EventName(topics []common.Hash) string {
+func (s *GlueUSV2Pair) EventName(topics []common.Hash) (string, error) {
 	// Sync event is the only unindexed event
 	if len(topics) == 0 {
-		return "Sync"
+		return "Sync", nil
 	} else {
 		// Otherwise the first topic identifies the event
 		ev, err := s.contractABI.EventByID(topics[0])
 		if err != nil {
-			log.Error("contractABI.EventByID", "err", err)
-			panic(err)
+			return "", newError(ErrUnknownEvent, "contractABI.EventByID", err)
 		}
-		return ev.RawName
-	}
-}
-
-func (s *GlueUSV2Pair) LogFields(eventName string) ([]string, []string) {
-	// TODO: refactor this: unnamed args, use ABI types
-	tn, dnt := []string{}, []string{}
-
-	switch eventName {
-	case "Mint":
-		tn = append(tn, "sender")
-		dnt = append(dnt, "amount0", "biguint", "amount1", "biguint")
-	case "Burn":
-		tn = append(tn, "sender", "to")
-		dnt = append(dnt, "amount0", "biguint", "amount1", "biguint")
-	case "Swap":
-		tn = append(tn, "sender", "to")
-		dnt = append(dnt,
-			"amount0In", "biguint", "amount1In", "biguint",
-			"amount0Out", "biguint", "amount1Out", "biguint")
-	case "Sync":
-		dnt = append(dnt, "reserve0", "biguint", "reserve1", "biguint")
-	case "Approval":
-		tn = append(tn, "owner", "spender")
-		dnt = append(dnt, "value", "biguint")
-	case "Transfer":
-		tn = append(tn, "from", "to")
-		dnt = append(dnt, "value", "biguint")
-	}
-
-	return tn, dnt
-}
-
-func (s *GlueUSV2Pair) LastInsertedBlock(dbConn *pgxpool.Conn) uint64 {
-	getBlock := func(eventName string) uint64 {
-		q := "SELECT block FROM " + s.dbTableBase + eventName +
-			" WHERE pair = '" + s.pairTicker + "' ORDER BY block DESC LIMIT 1"
-		return dbQueryUint64(dbConn, q, []interface{}{})
-	}
-
-	blocks := []uint64{
-		getBlock("mint"),
-		getBlock("burn"),
-		getBlock("swap"),
-		getBlock("sync"),
-		getBlock("approval"),
-		getBlock("transfer"),
+		return ev.RawName, nil
 	}
+}
+
+func (s *GlueUSV2Pair) LastInsertedBlock(ctx context.Context, dbConn dbQuerier) (uint64, error) {
+	getBlock := func(eventName string) (uint64, error) {
+		t, err := dbTable(s.dbTableBase + eventName)
+		if err != nil {
+			return 0, err
+		}
+		q := "SELECT block FROM " + t + " WHERE pair_id = $1 ORDER BY block DESC LIMIT 1"
+		return dbQueryUint64(ctx, dbConn, q, []interface{}{s.pairID})
+	}
+
 	var last uint64
-	for _, b := range blocks {
+	for _, t := range usPairEventTables {
+		b, err := getBlock(t)
+		if err != nil {
+			return 0, err
+		}
 		if b > last {
 			last = b
 		}
 	}
-	return last
+	return last, nil
 }
 
-func (s *GlueUSV2Pair) Insert(dbConn *pgxpool.Conn, ec *ethclient.Client, l types.Log, args []interface{}) {
-	eventName := s.EventName(l.Topics)
-	insertQuery := "INSERT INTO " + s.dbTableBase + eventName + " (pair, block, tx_hash, "
-
-	switch eventName {
-	case "Mint":
-		insertQuery += ("sender, amount0, amount1) VALUES ('"+ s.pairTicker + "', $1, $2, $3, $4, $5)")
-	case "Burn":
-		insertQuery += ("sender, dest, amount0, amount1) VALUES ('" + s.pairTicker + "', $1, $2, $3, $4, $5, $6)")
-	case "Swap":
-		insertQuery += ("sender, dest, amount0In, amount1In, amount0Out, amount1Out) VALUES ('" + s.pairTicker + "', $1, $2, $3, $4, $5, $6, $7, $8)")
-	case "Sync":
-		insertQuery += ("reserve0, reserve1) VALUES ('" + s.pairTicker + "', $1, $2, $3, $4)")
-	case "Approval":
-		insertQuery += ("owner, spender, value) VALUES ('" + s.pairTicker + "', $1, $2, $3, $4, $5)")
-	case "Transfer":
-		insertQuery += ("sender, dest, value) VALUES ('" + s.pairTicker + "', $1, $2, $3, $4, $5)")
+func (s *GlueUSV2Pair) Insert(w *dbWriter, ec *ethclient.Client, l types.Log, d *decodedLog) error {
+	if d.event == "Sync" {
+		w.setPairState(s.pairID, l, d.raw("reserve0").(*big.Int), d.raw("reserve1").(*big.Int))
 	}
-
-	dbExec(dbConn, insertQuery, args)
+	cols := append(append([]string{"pair_id"}, logColumns...), d.cols...)
+	vals := append(append([]interface{}{s.pairID}, logValues(l)...), d.vals...)
+	return w.insert(s.dbTableBase+strings.ToLower(d.event), cols, vals)
 }
 
+var (
+	abiCacheMu sync.Mutex
+	abiCache = make(map[string]*abi.ABI)
+)
+
+// loadABI parses a JSON ABI once and returns the cached result afterwards,
+// as a GlueUSV2Pair is created for each of the thousands of pairs.
+func loadABI(s string) (*abi.ABI, error) {
+	abiCacheMu.Lock()
+	defer abiCacheMu.Unlock()
 
-func loadABI(s string) abi.ABI {
+	if a, ok := abiCache[s]; ok {
+		return a, nil
+	}
 	a, err := abi.JSON(strings.NewReader(s))
 	if err != nil {
-		log.Error("abi.JSON", "err", err)
-		panic(err)
+		return nil, decodeError("abi.JSON", err)
 	}
-	return a
+	abiCache[s] = &a
+	return &a, nil
 }
@@ -4,6 +4,9 @@ go 1.15
 
 require (
 	github.com/ethereum/go-ethereum v1.9.20
+	github.com/jackc/pgconn v1.6.4
+	github.com/jackc/pgtype v1.4.2
 	github.com/jackc/pgx/v4 v4.8.1
 	github.com/urfave/cli v1.22.4
+	gopkg.in/yaml.v2 v2.2.2
 )
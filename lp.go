@@ -0,0 +1,177 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jackc/pgtype"
+)
+
+// LP positions.
+//
+// The LP token balances of every holder and the total supply of every pair
+// are replayed from us_pair_transfer into lp_balances and lp_supply, one
+// row per pair, holder and block with a change. Transfers from the zero
+// address mint, transfers from other addresses to the zero address burn.
+// The first mint of a pair locks MINIMUM_LIQUIDITY by minting it to the
+// zero address, which thus holds it. After each range is synced its rows
+// are deleted and computed again from the balances before the range, in
+// the same transaction, so syncing a range again gives the same result.
+
+// LPPosition is the LP token balance of a holder and the amounts of the
+// pair tokens it can be burned for.
+type LPPosition struct {
+	PairID uint64
+	Holder common.Address
+	Block uint64
+	Balance, TotalSupply *big.Int
+	// share of the reserves, nil without a Sync or supply
+	Amount0, Amount1 *big.Int
+}
+
+// lpBalancesSQL computes the balances of holders with transfers in blocks
+// [$1, $2], $3 is the zero address.
+const lpBalancesSQL = `
+WITH deltas AS (
+	SELECT pair_id, dest AS holder, block, value AS delta
+	FROM us_pair_transfer
+	WHERE block BETWEEN $1 AND $2 AND (dest <> $3 OR sender = $3)
+	UNION ALL
+	SELECT pair_id, sender AS holder, block, -value AS delta
+	FROM us_pair_transfer
+	WHERE block BETWEEN $1 AND $2 AND sender <> $3
+), per_block AS (
+	SELECT pair_id, holder, block, sum(delta) AS delta
+	FROM deltas
+	GROUP BY pair_id, holder, block
+)
+INSERT INTO lp_balances (pair_id, holder, block, balance)
+SELECT d.pair_id, d.holder, d.block,
+	coalesce((SELECT b.balance FROM lp_balances b
+		WHERE b.pair_id = d.pair_id AND b.holder = d.holder AND b.block < $1
+		ORDER BY b.block DESC LIMIT 1), 0)
+	+ sum(d.delta) OVER (PARTITION BY d.pair_id, d.holder ORDER BY d.block)
+FROM per_block d
+`
+
+// lpSupplySQL computes the total supply of pairs with mints or burns in
+// blocks [$1, $2], $3 is the zero address.
+const lpSupplySQL = `
+WITH per_block AS (
+	SELECT pair_id, block, sum(CASE WHEN sender = $3 THEN value ELSE -value END) AS delta
+	FROM us_pair_transfer
+	WHERE block BETWEEN $1 AND $2 AND (sender = $3 OR dest = $3)
+	GROUP BY pair_id, block
+)
+INSERT INTO lp_supply (pair_id, block, total_supply)
+SELECT d.pair_id, d.block,
+	coalesce((SELECT s.total_supply FROM lp_supply s
+		WHERE s.pair_id = d.pair_id AND s.block < $1
+		ORDER BY s.block DESC LIMIT 1), 0)
+	+ sum(d.delta) OVER (PARTITION BY d.pair_id ORDER BY d.block)
+FROM per_block d
+`
+
+// dbBuildLPBalances computes the LP balances and supplies of blocks
+// [fromBlock, toBlock] from the balances before fromBlock.
+func dbBuildLPBalances(ctx context.Context, dbConn dbQuerier, fromBlock, toBlock uint64) error {
+	zero := common.Address{}.Hex()
+	for _, t := range []string{"lp_balances", "lp_supply"} {
+		tn, err := dbTable(t)
+		if err != nil {
+			return err
+		}
+		err = dbExec(ctx, dbConn, "DELETE FROM "+tn+" WHERE block BETWEEN $1 AND $2", []interface{}{fromBlock, toBlock})
+		if err != nil {
+			return err
+		}
+	}
+	err := dbExec(ctx, dbConn, lpBalancesSQL, []interface{}{fromBlock, toBlock, zero})
+	if err != nil {
+		return err
+	}
+	return dbExec(ctx, dbConn, lpSupplySQL, []interface{}{fromBlock, toBlock, zero})
+}
+
+// LPPositionAt returns the LP position of holder in pair pairID at block.
+func LPPositionAt(ctx context.Context, cfg *Config, pairID uint64, holder common.Address, block uint64) (*LPPosition, error) {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return dbLPPositionAt(ctx, dbPool, pairID, holder, block)
+}
+
+func dbLPPositionAt(ctx context.Context, dbConn dbQuerier, pairID uint64, holder common.Address, block uint64) (*LPPosition, error) {
+	q := "SELECT " +
+		"(SELECT balance FROM lp_balances WHERE pair_id = $1 AND holder = $2 AND block <= $3 ORDER BY block DESC LIMIT 1), " +
+		"(SELECT total_supply FROM lp_supply WHERE pair_id = $1 AND block <= $3 ORDER BY block DESC LIMIT 1)"
+	rows, err := dbConn.Query(ctx, q, pairID, holder.Hex(), block)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	var balance, supply pgtype.Numeric
+	for rows.Next() {
+		err = rows.Scan(&balance, &supply)
+		if err != nil {
+			rows.Close()
+			return nil, dbError("rows.Scan", err)
+		}
+	}
+	rows.Close()
+	err = dbRowsErr(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := &LPPosition{PairID: pairID, Holder: holder, Block: block, Balance: new(big.Int), TotalSupply: new(big.Int)}
+	if balance.Status == pgtype.Present {
+		pos.Balance = numericInt(balance)
+	}
+	if supply.Status == pgtype.Present {
+		pos.TotalSupply = numericInt(supply)
+	}
+	if pos.TotalSupply.Sign() == 0 {
+		return pos, nil
+	}
+
+	ps, err := dbReservesAt(ctx, dbConn, pairID, block)
+	if err != nil {
+		return nil, err
+	}
+	if ps == nil {
+		return nil, fmt.Errorf("no Sync of pair %d at or before block %d", pairID, block)
+	}
+	pos.Amount0, pos.Amount1 = lpShare(pos.Balance, pos.TotalSupply, ps.Reserve0, ps.Reserve1)
+	return pos, nil
+}
+
+// lpShare returns the amounts of reserves burning balance of supply LP
+// tokens gives, rounded down as by UniswapV2Pair.burn.
+func lpShare(balance, supply, reserve0, reserve1 *big.Int) (*big.Int, *big.Int) {
+	a0 := new(big.Int).Mul(balance, reserve0)
+	a1 := new(big.Int).Mul(balance, reserve1)
+	return a0.Quo(a0, supply), a1.Quo(a1, supply)
+}
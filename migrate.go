@@ -0,0 +1,205 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type migration struct {
+	version int
+	name string
+	up, down string
+}
+
+func (m migration) checksum() string {
+	h := sha256.Sum256([]byte(m.up))
+	return hex.EncodeToString(h[:])
+}
+
+const schemaVersionDDL = `CREATE TABLE IF NOT EXISTS schema_version (
+	version    INTEGER     PRIMARY KEY,
+	name       TEXT        NOT NULL,
+	checksum   TEXT        NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// MigrateUp applies all pending migrations.
+func MigrateUp(ctx context.Context, cfg *Config) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dbConn, err := getDBConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Release()
+
+	return migrateUp(ctx, dbConn)
+}
+
+// MigrateDown reverts applied migrations until the schema is at version.
+func MigrateDown(ctx context.Context, cfg *Config, version int) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dbConn, err := getDBConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Release()
+
+	return migrateDown(ctx, dbConn, version)
+}
+
+func migrateUp(ctx context.Context, dbConn *pgxpool.Conn) error {
+	applied, err := loadSchemaVersions(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		t0 := time.Now()
+		err = execMigration(ctx, dbConn, m.up, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx,
+				"INSERT INTO schema_version (version, name, checksum) VALUES ($1, $2, $3)",
+				m.version, m.name, m.checksum())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Info("migration applied", "version", m.version, "name", m.name, "t", time.Since(t0))
+	}
+	return nil
+}
+
+func migrateDown(ctx context.Context, dbConn *pgxpool.Conn, version int) error {
+	applied, err := loadSchemaVersions(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		err = execMigration(ctx, dbConn, m.down, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx,
+				"DELETE FROM schema_version WHERE version = $1", m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("revert migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Info("migration reverted", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// execMigration runs the migration SQL and the schema_version bookkeeping
+// in a single transaction.
+func execMigration(ctx context.Context, dbConn *pgxpool.Conn, sql string, record func(pgx.Tx) error) error {
+	tx, err := dbConn.Begin(ctx)
+	if err != nil {
+		return dbError("dbConn.Begin", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		return dbError("tx.Exec", err)
+	}
+	err = record(tx)
+	if err != nil {
+		return dbError("schema_version tx.Exec", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return dbError("tx.Commit", err)
+	}
+	return nil
+}
+
+// loadSchemaVersions returns the applied migrations by version and verifies
+// that they still match the ones compiled into this binary.
+func loadSchemaVersions(ctx context.Context, dbConn *pgxpool.Conn) (map[int]string, error) {
+	_, err := dbConn.Exec(ctx, schemaVersionDDL)
+	if err != nil {
+		return nil, dbError("dbConn.Exec", err)
+	}
+
+	rows, err := dbConn.Query(ctx, "SELECT version, checksum FROM schema_version")
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var checksum string
+		err = rows.Scan(&version, &checksum)
+		if err != nil {
+			return nil, dbError("rows.Scan", err)
+		}
+		applied[version] = checksum
+	}
+	err = dbRowsErr(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]migration)
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+	for version, checksum := range applied {
+		m, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("schema version %d is newer than this binary", version)
+		}
+		if m.checksum() != checksum {
+			log.Error("schema_version checksum mismatch", "version", version, "db", checksum, "binary", m.checksum())
+			return nil, fmt.Errorf("checksum mismatch for schema version %d (%s)", version, m.name)
+		}
+	}
+
+	return applied, nil
+}
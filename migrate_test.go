@@ -0,0 +1,88 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"testing"
+)
+
+// TestMigrationOrphanRows applies the migrations up to v6 in a scratch
+// schema with an event row whose pair is missing from us_factory.
+func TestMigrationOrphanRows(t *testing.T) {
+	cfg := testDBConfig(t)
+	ctx := context.Background()
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	dbConn, err := getDBConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.Release()
+
+	tx, err := dbConn.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "CREATE SCHEMA kanot_migration_test; SET LOCAL search_path TO kanot_migration_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := func(version int) {
+		for _, m := range migrations {
+			if m.version == version {
+				_, err := tx.Exec(ctx, m.up)
+				if err != nil {
+					t.Fatalf("migration %d: %v", version, err)
+				}
+				return
+			}
+		}
+		t.Fatalf("no migration %d", version)
+	}
+	for v := 1; v <= 5; v++ {
+		exec(v)
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO us_factory (pair, block, tx_hash, token0, token1, pair_addr, pair_id)
+VALUES ('WETH-USDC-0', 10000835, '0x01', '0x02', '0x03', '0x04', 0);
+INSERT INTO us_pair_mint (pair, block, tx_hash, sender, amount0, amount1) VALUES
+	('WETH-USDC-0', 10000836, '0x05', '0x06', '1', '2'),
+	('WETH-DAI-1', 10000837, '0x07', '0x06', '3', '4');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(6)
+
+	var n int
+	var pairID int64
+	err = tx.QueryRow(ctx, "SELECT count(*), max(pair_id) FROM us_pair_mint").Scan(&n, &pairID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || pairID != 0 {
+		t.Errorf("us_pair_mint has %d rows with max pair_id %d, want 1 row of pair_id 0", n, pairID)
+	}
+}
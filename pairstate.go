@@ -0,0 +1,209 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// Pair state.
+//
+// The pair_state table holds the reserves of every pair after its latest
+// Sync event, their product k and the spot prices in both directions,
+// scaled by the token decimals. The latest Sync of each pair in a range is
+// buffered by the dbWriter and written on flush, after the events, with
+// the prices computed from the tokens table. ReservesAt answers the same
+// for any past block from us_pair_sync.
+
+// PairState is the state of a pair after a Sync event.
+type PairState struct {
+	PairID uint64
+	Block uint64
+	Reserve0, Reserve1 *big.Int
+	K *big.Int
+	// price of token0 in token1 and of token1 in token0, nil if the
+	// decimals of a token are unknown or a reserve is zero
+	Price0, Price1 *big.Rat
+}
+
+// pairStateRow is a Sync event buffered by the dbWriter.
+type pairStateRow struct {
+	block uint64
+	logIndex uint
+	reserve0, reserve1 *big.Int
+}
+
+// setPairState buffers the reserves of pair pairID after log l, replacing
+// an earlier buffered Sync of the pair.
+func (w *dbWriter) setPairState(pairID uint64, l types.Log, reserve0, reserve1 *big.Int) {
+	r, ok := w.pairStates[pairID]
+	if ok && (r.block > l.BlockNumber || r.block == l.BlockNumber && r.logIndex > l.Index) {
+		return
+	}
+	w.pairStates[pairID] = &pairStateRow{l.BlockNumber, l.Index, reserve0, reserve1}
+}
+
+// flushPairStates upserts the buffered pair states. Rows are only replaced
+// by later Syncs, so ingesting a range again leaves pair_state unchanged.
+func (w *dbWriter) flushPairStates() error {
+	if len(w.pairStates) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(w.pairStates))
+	for id := range w.pairStates {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	q := "INSERT INTO pair_state (pair_id, block, log_index, reserve0, reserve1, k, price0, price1) " +
+		"SELECT f.pair_id, $2::BIGINT, $3::INTEGER, $4::NUMERIC, $5::NUMERIC, $4::NUMERIC * $5::NUMERIC, " +
+		"spot_price($4::NUMERIC, t0.decimals, $5::NUMERIC, t1.decimals), " +
+		"spot_price($5::NUMERIC, t1.decimals, $4::NUMERIC, t0.decimals) " +
+		"FROM us_factory f " +
+		"LEFT JOIN tokens t0 ON t0.addr = f.token0 " +
+		"LEFT JOIN tokens t1 ON t1.addr = f.token1 " +
+		"WHERE f.pair_id = $1 " +
+		"ON CONFLICT (pair_id) DO UPDATE SET block = EXCLUDED.block, log_index = EXCLUDED.log_index, " +
+		"reserve0 = EXCLUDED.reserve0, reserve1 = EXCLUDED.reserve1, k = EXCLUDED.k, " +
+		"price0 = EXCLUDED.price0, price1 = EXCLUDED.price1, updated_at = now() " +
+		"WHERE (pair_state.block, coalesce(pair_state.log_index, -1)) < (EXCLUDED.block, EXCLUDED.log_index)"
+	b := &pgx.Batch{}
+	for _, id := range ids {
+		r := w.pairStates[id]
+		b.Queue(q, id, r.block, r.logIndex, dbNumeric(r.reserve0), dbNumeric(r.reserve1))
+	}
+	br := w.tx.SendBatch(w.ctx, b)
+	for range ids {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return dbError("tx.SendBatch", err)
+		}
+	}
+	err := br.Close()
+	if err != nil {
+		return dbError("tx.SendBatch", err)
+	}
+	w.pairStates = make(map[uint64]*pairStateRow)
+	return nil
+}
+
+// dbRebuildPairState sets the state of pairs with a Sync above block
+// ancestor to their latest Sync in us_pair_sync, after a rollback.
+func dbRebuildPairState(ctx context.Context, dbConn dbQuerier, ancestor uint64) error {
+	rows, err := dbConn.Query(ctx, "DELETE FROM pair_state WHERE block > $1 RETURNING pair_id", ancestor)
+	if err != nil {
+		return dbError("dbConn.Query", err)
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return dbError("rows.Scan", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = dbRowsErr(rows)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	q := "INSERT INTO pair_state (pair_id, block, log_index, reserve0, reserve1, k, price0, price1) " +
+		"SELECT DISTINCT ON (s.pair_id) s.pair_id, s.block, s.log_index, s.reserve0, s.reserve1, " +
+		"s.reserve0 * s.reserve1, " +
+		"spot_price(s.reserve0, t0.decimals, s.reserve1, t1.decimals), " +
+		"spot_price(s.reserve1, t1.decimals, s.reserve0, t0.decimals) " +
+		"FROM us_pair_sync s " +
+		"JOIN us_factory f ON f.pair_id = s.pair_id " +
+		"LEFT JOIN tokens t0 ON t0.addr = f.token0 " +
+		"LEFT JOIN tokens t1 ON t1.addr = f.token1 " +
+		"WHERE s.pair_id = ANY($1) " +
+		"ORDER BY s.pair_id, s.block DESC, s.log_index DESC NULLS LAST"
+	return dbExec(ctx, dbConn, q, []interface{}{ids})
+}
+
+// ReservesAt returns the state of pair pairID after the last Sync at or
+// before block, nil if there is none.
+func ReservesAt(ctx context.Context, cfg *Config, pairID, block uint64) (*PairState, error) {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return dbReservesAt(ctx, dbPool, pairID, block)
+}
+
+func dbReservesAt(ctx context.Context, dbConn dbQuerier, pairID, block uint64) (*PairState, error) {
+	q := "SELECT s.block, s.reserve0, s.reserve1, t0.decimals, t1.decimals " +
+		"FROM us_pair_sync s " +
+		"JOIN us_factory f ON f.pair_id = s.pair_id " +
+		"LEFT JOIN tokens t0 ON t0.addr = f.token0 " +
+		"LEFT JOIN tokens t1 ON t1.addr = f.token1 " +
+		"WHERE s.pair_id = $1 AND s.block <= $2 " +
+		"ORDER BY s.block DESC, s.log_index DESC NULLS LAST LIMIT 1"
+	rows, err := dbConn.Query(ctx, q, pairID, block)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, dbRowsErr(rows)
+	}
+	ps := &PairState{PairID: pairID}
+	var r0, r1 pgtype.Numeric
+	var d0, d1 *int16
+	err = rows.Scan(&ps.Block, &r0, &r1, &d0, &d1)
+	if err != nil {
+		return nil, dbError("rows.Scan", err)
+	}
+	ps.Reserve0, ps.Reserve1 = numericInt(r0), numericInt(r1)
+	ps.K = new(big.Int).Mul(ps.Reserve0, ps.Reserve1)
+	if d0 != nil && d1 != nil {
+		ps.Price0 = spotPrice(ps.Reserve0, *d0, ps.Reserve1, *d1)
+		ps.Price1 = spotPrice(ps.Reserve1, *d1, ps.Reserve0, *d0)
+	}
+	return ps, dbRowsErr(rows)
+}
+
+// spotPrice returns the price of base in quote scaled by their decimals,
+// as the spot_price SQL function, or nil if base is zero.
+func spotPrice(base *big.Int, baseDecimals int16, quote *big.Int, quoteDecimals int16) *big.Rat {
+	if base.Sign() == 0 {
+		return nil
+	}
+	num := new(big.Int).Mul(quote, pow10(baseDecimals))
+	den := new(big.Int).Mul(base, pow10(quoteDecimals))
+	return new(big.Rat).SetFrac(num, den)
+}
+
+func pow10(n int16) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,625 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/jackc/pgx/v4"
+	"gopkg.in/yaml.v2"
+)
+
+// Contract registry.
+//
+// Contracts other than Uniswap V2 are described by YAML files in
+// cfg.ContractsDir, one contract per file:
+//
+//	name: mkr
+//	abi: dstoken.abi        # file in cfg.ABIDir
+//	address: 0x9f8F72aA9304c8B593d555F12eF6589cC3A579A2
+//	start_block: 4620855
+//	events:                 # event name: table
+//	  Transfer: mkr_transfer
+//
+// Instead of an address, a contract can be discovered from an address
+// argument of an event of another registry contract, which must be mapped
+// to a table:
+//
+//	factory:
+//	  contract: somefactory
+//	  event: PoolCreated
+//	  arg: pool
+//
+// Event tables are created at startup with the columns contract, the
+// logColumns and one column per event argument, see decode.go. Events not
+// mapped to a table are skipped, and so are logs whose topic matches no
+// event of the ABI, such as anonymous events.
+//
+// Registry contracts with an address that were added after the sync
+// started are backfilled from their start block, together with the
+// contracts they create, before the sync continues. The block up to which
+// a contract is synced is kept in sync_cursor as "registry:<name>", so an
+// interrupted backfill resumes where it stopped.
+
+// ContractSpec is a contract registry file.
+type ContractSpec struct {
+	Name string `yaml:"name"`
+	ABI string `yaml:"abi"`
+	Address string `yaml:"address"`
+	Factory *FactorySpec `yaml:"factory"`
+	StartBlock uint64 `yaml:"start_block"`
+	Events map[string]string `yaml:"events"`
+}
+
+// FactorySpec describes the event of a registry contract that creates
+// instances of another one.
+type FactorySpec struct {
+	Contract string `yaml:"contract"`
+	Event string `yaml:"event"`
+	// column of the address argument, see columnName
+	Arg string `yaml:"arg"`
+}
+
+var registryNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Registry holds the loaded contract registry files.
+type Registry struct {
+	specs []*ContractSpec
+	abis map[string]*abi.ABI
+	// child specs by name of their factory
+	children map[string][]*ContractSpec
+}
+
+// LoadRegistry loads all *.yaml files in dir, with ABI files in abiDir,
+// and adds their event tables to the tables kanot writes. An empty dir
+// returns an empty registry.
+func LoadRegistry(dir, abiDir string) (*Registry, error) {
+	r := &Registry{
+		abis: make(map[string]*abi.ABI),
+		children: make(map[string][]*ContractSpec),
+	}
+	if dir == "" {
+		return r, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	byName := make(map[string]*ContractSpec)
+	tables := make(map[string]string)
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		spec := &ContractSpec{}
+		err = yaml.UnmarshalStrict(b, spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if !registryNameRe.MatchString(spec.Name) {
+			return nil, fmt.Errorf("%s: invalid name %q", f, spec.Name)
+		}
+		if byName[spec.Name] != nil {
+			return nil, fmt.Errorf("%s: duplicate name %q", f, spec.Name)
+		}
+		if (spec.Address == "") == (spec.Factory == nil) {
+			return nil, fmt.Errorf("%s: exactly one of address and factory must be given", f)
+		}
+		if spec.Address != "" && !common.IsHexAddress(spec.Address) {
+			return nil, fmt.Errorf("%s: invalid address %q", f, spec.Address)
+		}
+
+		a, err := ioutil.ReadFile(filepath.Join(abiDir, filepath.Base(spec.ABI)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		r.abis[spec.Name], err = loadABI(string(a))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for ev, t := range spec.Events {
+			e, ok := r.abis[spec.Name].Events[ev]
+			if !ok {
+				return nil, fmt.Errorf("%s: no event %s in %s", f, ev, spec.ABI)
+			}
+			if e.Anonymous {
+				return nil, fmt.Errorf("%s: anonymous event %s cannot be identified", f, ev)
+			}
+			for i, arg := range e.Inputs {
+				switch columnName(arg, i) {
+				case "contract", "block", "tx_hash", "tx_index", "log_index", "block_hash":
+					return nil, fmt.Errorf("%s: argument %s of %s clashes with column %s", f, arg.Name, ev, columnName(arg, i))
+				}
+			}
+			if tables[t] != "" {
+				return nil, fmt.Errorf("%s: table %s already used by %s", f, t, tables[t])
+			}
+			tables[t] = spec.Name
+			err = addDBTable(t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+		}
+
+		byName[spec.Name] = spec
+		r.specs = append(r.specs, spec)
+	}
+
+	for _, spec := range r.specs {
+		if spec.Factory == nil {
+			continue
+		}
+		fs := spec.Factory
+		parent := byName[fs.Contract]
+		if parent == nil {
+			return nil, fmt.Errorf("%s: unknown factory contract %q", spec.Name, fs.Contract)
+		}
+		if parent.Events[fs.Event] == "" {
+			return nil, fmt.Errorf("%s: factory event %s.%s is not mapped to a table", spec.Name, fs.Contract, fs.Event)
+		}
+		ev := r.abis[parent.Name].Events[fs.Event]
+		found := false
+		for i, arg := range ev.Inputs {
+			if columnName(arg, i) == fs.Arg && arg.Type.T == abi.AddressTy {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: factory event %s.%s has no address argument %q", spec.Name, fs.Contract, fs.Event, fs.Arg)
+		}
+		r.children[parent.Name] = append(r.children[parent.Name], spec)
+	}
+
+	return r, nil
+}
+
+// registryTable is the event table of an event of a registry contract.
+type registryTable struct {
+	name string
+	cols []registryColumn
+}
+
+type registryColumn struct {
+	name string
+	// SQL type without constraints
+	typ string
+}
+
+// registryLogColumns are the logColumns and their types.
+var registryLogColumns = []registryColumn{
+	{"block", "BIGINT"},
+	{"tx_hash", "TEXT"},
+	{"tx_index", "INTEGER"},
+	{"log_index", "INTEGER"},
+	{"block_hash", "TEXT"},
+}
+
+// tables returns the event tables of all registry contracts in the order
+// of their contracts and events.
+func (r *Registry) tables() []*registryTable {
+	res := []*registryTable{}
+	for _, spec := range r.specs {
+		a := r.abis[spec.Name]
+		evs := make([]string, 0, len(spec.Events))
+		for ev := range spec.Events {
+			evs = append(evs, ev)
+		}
+		sort.Strings(evs)
+
+		for _, ev := range evs {
+			t := &registryTable{name: spec.Events[ev]}
+			t.cols = append(append(t.cols, registryColumn{"contract", "TEXT"}), registryLogColumns...)
+			for i, arg := range a.Events[ev].Inputs {
+				t.cols = append(t.cols, registryColumn{columnName(arg, i), columnType(arg)})
+			}
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func (t *registryTable) createSQL() string {
+	cols := make([]string, len(t.cols))
+	for i, c := range t.cols {
+		cols[i] = pgx.Identifier{c.name}.Sanitize() + " " + c.typ
+		if i <= len(registryLogColumns) {
+			cols[i] += " NOT NULL"
+		}
+	}
+	return "CREATE TABLE IF NOT EXISTS " + pgx.Identifier{t.name}.Sanitize() + " (\n\t" + strings.Join(cols, ",\n\t") + "\n)"
+}
+
+func (t *registryTable) indexSQL() []string {
+	tn := pgx.Identifier{t.name}.Sanitize()
+	return []string{
+		"CREATE INDEX IF NOT EXISTS " + pgx.Identifier{t.name + "_contract_block_idx"}.Sanitize() + " ON " + tn + " (contract, block)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS " + pgx.Identifier{t.name + "_block_log_index_idx"}.Sanitize() + " ON " + tn + " (block, log_index)",
+	}
+}
+
+// DDL returns the statements creating the event tables of all registry
+// contracts.
+func (r *Registry) DDL() []string {
+	res := []string{}
+	for _, t := range r.tables() {
+		res = append(append(res, t.createSQL()), t.indexSQL()...)
+	}
+	return res
+}
+
+// Tables returns the event tables of all registry contracts.
+func (r *Registry) Tables() []string {
+	res := []string{}
+	for _, spec := range r.specs {
+		for _, t := range spec.Events {
+			res = append(res, t)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// createTables creates missing event tables and upgrades existing ones,
+// see upgradeTable.
+func (r *Registry) createTables(ctx context.Context, dbConn dbQuerier) error {
+	for _, t := range r.tables() {
+		err := dbExec(ctx, dbConn, t.createSQL(), []interface{}{})
+		if err != nil {
+			return err
+		}
+		err = upgradeTable(ctx, dbConn, t)
+		if err != nil {
+			return err
+		}
+		for _, q := range t.indexSQL() {
+			err = dbExec(ctx, dbConn, q, []interface{}{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeTable compares the columns of an existing event table to t.
+// Amounts stored as TEXT before they were NUMERIC are converted and
+// missing log positions are added, NULL for the rows already ingested, as
+// for the Uniswap tables. Any other difference means the table was created
+// from another ABI and is an error.
+func upgradeTable(ctx context.Context, dbConn dbQuerier, t *registryTable) error {
+	q := "SELECT a.attname, format_type(a.atttypid, a.atttypmod) FROM pg_attribute a " +
+		"WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped"
+	rows, err := dbConn.Query(ctx, q, pgx.Identifier{t.name}.Sanitize())
+	if err != nil {
+		return dbError("dbConn.Query", err)
+	}
+	have := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		err = rows.Scan(&name, &typ)
+		if err != nil {
+			rows.Close()
+			return dbError("rows.Scan", err)
+		}
+		have[name] = typ
+	}
+	rows.Close()
+	err = dbRowsErr(rows)
+	if err != nil {
+		return err
+	}
+
+	tn := pgx.Identifier{t.name}.Sanitize()
+	for _, c := range t.cols {
+		cn := pgx.Identifier{c.name}.Sanitize()
+		typ, ok := have[c.name]
+		switch {
+		case !ok && isLogColumn(c.name):
+			log.Info("adding log position column", "table", t.name, "column", c.name)
+			err = dbExec(ctx, dbConn, "ALTER TABLE "+tn+" ADD COLUMN "+cn+" "+c.typ, []interface{}{})
+		case !ok:
+			return fmt.Errorf("registry table %s has no column %s, it was created from another ABI", t.name, c.name)
+		case strings.EqualFold(typ, c.typ):
+		case typ == "text" && c.typ == "NUMERIC(78,0)":
+			log.Info("converting column to NUMERIC", "table", t.name, "column", c.name)
+			err = dbExec(ctx, dbConn, "ALTER TABLE "+tn+" ALTER COLUMN "+cn+" TYPE NUMERIC(78,0) USING "+cn+"::NUMERIC(78,0)", []interface{}{})
+		default:
+			return fmt.Errorf("registry table %s: column %s is %s, want %s, it was created from another ABI", t.name, c.name, typ, c.typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isLogColumn(name string) bool {
+	for _, c := range logColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadChildren returns all instances of factory-discovered contracts
+// recorded in the event tables of their factories.
+func (r *Registry) loadChildren(ctx context.Context, dbConn dbQuerier) ([]ContractSync, error) {
+	res := []ContractSync{}
+	for _, spec := range r.specs {
+		if spec.Factory == nil {
+			continue
+		}
+
+		fs := spec.Factory
+		t, err := dbTable(r.specByName(fs.Contract).Events[fs.Event])
+		if err != nil {
+			return nil, err
+		}
+		q := "SELECT " + pgx.Identifier{fs.Arg}.Sanitize() + ", block FROM " + t + " ORDER BY block"
+		addrs, blocks, err := dbQueryAddrBlocks(ctx, dbConn, q, []interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		for i, a := range addrs {
+			res = append(res, r.newContract(spec, a, blocks[i]))
+		}
+	}
+	return res, nil
+}
+
+func (r *Registry) specByName(name string) *ContractSpec {
+	for _, spec := range r.specs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+func (r *Registry) newContract(spec *ContractSpec, addr common.Address, startBlock uint64) ContractSync {
+	c := &registryContract{
+		spec: spec,
+		reg: r,
+		addr: addr,
+		startBlock: startBlock,
+		contractABI: r.abis[spec.Name],
+	}
+	if len(r.children[spec.Name]) > 0 {
+		return &registryFactory{c}
+	}
+	return c
+}
+
+// registryCursorPrefix prefixes the names of registry contracts in
+// sync_cursor.
+const registryCursorPrefix = "registry:"
+
+// cursorName returns the name of the cursor of spec in sync_cursor.
+func (spec *ContractSpec) cursorName() string {
+	return registryCursorPrefix + spec.Name
+}
+
+// registryContract is the ContractSync of a registry contract.
+type registryContract struct {
+	spec *ContractSpec
+	reg *Registry
+	addr common.Address
+	startBlock uint64
+	contractABI *abi.ABI
+}
+
+func (s *registryContract) Name() string {
+	if s.spec.Factory != nil {
+		return s.spec.Name + "_" + s.addr.Hex()
+	}
+	return s.spec.Name
+}
+
+func (s *registryContract) Contract() (common.Address, uint64, *abi.ABI) {
+	return s.addr, s.startBlock, s.contractABI
+}
+
+func (s *registryContract) EventName(topics []common.Hash) (string, error) {
+	if len(topics) == 0 {
+		return "", newError(ErrUnknownEvent, "registryContract.EventName", fmt.Errorf("%s: log without topics", s.Name()))
+	}
+	ev, err := s.contractABI.EventByID(topics[0])
+	if err != nil {
+		return "", newError(ErrUnknownEvent, "contractABI.EventByID", err)
+	}
+	return ev.RawName, nil
+}
+
+func (s *registryContract) LastInsertedBlock(ctx context.Context, dbConn dbQuerier) (uint64, error) {
+	var last uint64
+	for _, table := range s.spec.Events {
+		t, err := dbTable(table)
+		if err != nil {
+			return 0, err
+		}
+		q := "SELECT block FROM " + t + " WHERE contract = $1 ORDER BY block DESC LIMIT 1"
+		b, err := dbQueryUint64(ctx, dbConn, q, []interface{}{s.addr.Hex()})
+		if err != nil {
+			return 0, err
+		}
+		if b > last {
+			last = b
+		}
+	}
+	return last, nil
+}
+
+func (s *registryContract) Insert(w *dbWriter, ec *ethclient.Client, l types.Log, d *decodedLog) error {
+	table, ok := s.spec.Events[d.event]
+	if !ok {
+		return nil
+	}
+	cols := append(append([]string{"contract"}, logColumns...), d.cols...)
+	vals := append(append([]interface{}{s.addr.Hex()}, logValues(l)...), d.vals...)
+	return w.insert(table, cols, vals)
+}
+
+// registryFactory is a registry contract with factory-discovered children.
+type registryFactory struct {
+	*registryContract
+}
+
+func (s *registryFactory) Discover(l types.Log, d *decodedLog) ([]ContractSync, error) {
+	res := []ContractSync{}
+	for _, spec := range s.reg.children[s.spec.Name] {
+		if spec.Factory.Event != d.event {
+			continue
+		}
+		a, ok := d.raw(spec.Factory.Arg).(common.Address)
+		if !ok {
+			return nil, decodeError("registryFactory.Discover", fmt.Errorf("%s: no address %s in %s", s.Name(), spec.Factory.Arg, d.event))
+		}
+		res = append(res, s.reg.newContract(spec, a, l.BlockNumber))
+	}
+	return res, nil
+}
+
+// backfill syncs the registry contracts in s.backfills from their start
+// block, or where an earlier backfill stopped, up to the sync cursor, and
+// adds them to the address set. Contracts created by them are discovered
+// and synced along, see ingest.
+func (s *uniswapSync) backfill() error {
+	toBlock := s.fromBlock - 1
+	for len(s.backfills) > 0 {
+		spec := s.backfills[0]
+		addr := common.HexToAddress(spec.Address)
+		cs := s.reg.newContract(spec, addr, spec.StartBlock)
+		s.csm[addr] = cs
+
+		fromBlock := spec.StartBlock
+		cursor, ok, err := dbQuerySyncCursor(s.dbCtx, s.dbConn, spec.cursorName())
+		if err != nil {
+			return err
+		}
+		if ok {
+			fromBlock = cursor + 1
+		}
+		log.Info("backfilling", "contract", spec.Name, "fromBlock", fromBlock, "toBlock", toBlock)
+
+		as := []common.Address{addr}
+		for fb := fromBlock; fb <= toBlock; {
+			tb := fb + s.sizer.window() - 1
+			if tb > toBlock {
+				tb = toBlock
+			}
+			logs, t, err := s.getLogs(s.ctx, fb, tb, as)
+			if s.ctx.Err() != nil {
+				// shutting down
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			s.mu.RLock()
+			n := len(s.addrs)
+			s.mu.RUnlock()
+			ok, err := s.backfillRange(spec, fb, tb, logs, t, toBlock)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// reorg or shutdown, drop uncommitted contracts
+				return s.loadPairs()
+			}
+			// contracts created in the range
+			s.mu.RLock()
+			as = append(as, s.addrs[n:]...)
+			s.mu.RUnlock()
+
+			fb = tb + 1
+		}
+
+		// also when there was nothing to backfill
+		err = dbSetSyncCursor(s.dbCtx, s.dbConn, spec.cursorName(), toBlock)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.addrs = append(s.addrs, addr)
+		s.mu.Unlock()
+		s.backfills = s.backfills[1:]
+		log.Info("backfilled", "contract", spec.Name, "addrs", len(as))
+	}
+	return nil
+}
+
+func (s *uniswapSync) backfillRange(spec *ContractSpec, fromBlock, toBlock uint64, logs []types.Log, t time.Duration, maxBlock uint64) (bool, error) {
+	ctx := s.dbCtx
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return false, dbError("dbConn.Begin", err)
+	}
+	defer tx.Rollback(ctx)
+	w := newDBWriter(ctx, tx, s.cfg.CopyFlushSize)
+
+	logs, ok, err := s.ingest(w, fromBlock, toBlock, logs, t, maxBlock)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = w.flush()
+	if err != nil {
+		return false, err
+	}
+	headers, ok, err := s.logHeaders(nil, logs)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = dbUpsertBlocks(ctx, tx, headers)
+	if err != nil {
+		return false, err
+	}
+	err = s.enrichTxs(tx, logs)
+	if err != nil {
+		return false, err
+	}
+	err = dbSetSyncCursor(ctx, tx, spec.cursorName(), toBlock)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, dbError("tx.Commit", err)
+	}
+	return true, nil
+}
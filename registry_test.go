@@ -0,0 +1,128 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestRegistrySkipsUnknownEvents(t *testing.T) {
+	dsABI, err := abi.JSON(strings.NewReader(DSTokenABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &registryContract{
+		spec: &ContractSpec{Name: "mkr", Events: map[string]string{"Mint": "mkr_mint"}},
+		addr: common.HexToAddress("0x9f8F72aA9304c8B593d555F12eF6589cC3A579A2"),
+		contractABI: &dsABI,
+	}
+	s := &uniswapSync{}
+	amount, err := abi.Arguments{dsABI.Events["Transfer"].Inputs[2]}.Pack(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guy := common.BytesToHash(cs.addr.Bytes())
+
+	// anonymous LogNote of transfer(address,uint256): topic 0 is the
+	// function selector
+	note := types.Log{
+		Address: cs.addr,
+		Topics: []common.Hash{common.HexToHash("0xa9059cbb00000000000000000000000000000000000000000000000000000000"), guy, {}, {}},
+		Data: make([]byte, 96),
+	}
+	_, err = parseLog(note, cs)
+	if !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("parseLog(LogNote) = %v, want ErrUnknownEvent", err)
+	}
+	skipped := skippedLogs.Value()
+	err = s.insertLog(nil, note, cs)
+	if err != nil {
+		t.Errorf("insertLog(LogNote) = %v, want nil", err)
+	}
+	if skippedLogs.Value() != skipped+1 {
+		t.Errorf("LogNote not counted in skippedLogs")
+	}
+
+	// known event not mapped to a table
+	transfer := types.Log{
+		Address: cs.addr,
+		Topics: []common.Hash{dsABI.Events["Transfer"].ID, guy, guy},
+		Data: amount,
+	}
+	err = s.insertLog(nil, transfer, cs)
+	if err != nil {
+		t.Errorf("insertLog(Transfer) = %v, want nil", err)
+	}
+	if skippedLogs.Value() != skipped+1 {
+		t.Errorf("unmapped Transfer counted in skippedLogs")
+	}
+
+	err = s.insertLog(nil, types.Log{Address: cs.addr}, cs)
+	if err != nil {
+		t.Errorf("insertLog(no topics) = %v, want nil", err)
+	}
+}
+
+func TestRegistryTables(t *testing.T) {
+	dsABI, err := abi.JSON(strings.NewReader(DSTokenABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &ContractSpec{Name: "mkr", Events: map[string]string{"Transfer": "mkr_transfer", "Mint": "mkr_mint"}}
+	r := &Registry{specs: []*ContractSpec{spec}, abis: map[string]*abi.ABI{"mkr": &dsABI}}
+
+	if len(registryLogColumns) != len(logColumns) {
+		t.Fatalf("registryLogColumns has %d columns, logColumns %d", len(registryLogColumns), len(logColumns))
+	}
+	for i, c := range registryLogColumns {
+		if c.name != logColumns[i] {
+			t.Errorf("registryLogColumns[%d] = %s, want %s", i, c.name, logColumns[i])
+		}
+	}
+
+	tables := r.tables()
+	if len(tables) != 2 || tables[0].name != "mkr_mint" || tables[1].name != "mkr_transfer" {
+		t.Fatalf("tables = %+v", tables)
+	}
+	want := "CREATE TABLE IF NOT EXISTS \"mkr_transfer\" (\n" +
+		"\t\"contract\" TEXT NOT NULL,\n" +
+		"\t\"block\" BIGINT NOT NULL,\n" +
+		"\t\"tx_hash\" TEXT NOT NULL,\n" +
+		"\t\"tx_index\" INTEGER NOT NULL,\n" +
+		"\t\"log_index\" INTEGER NOT NULL,\n" +
+		"\t\"block_hash\" TEXT NOT NULL,\n" +
+		"\t\"sender\" TEXT,\n" +
+		"\t\"dest\" TEXT,\n" +
+		"\t\"value\" NUMERIC(78,0)\n" +
+		")"
+	if got := tables[1].createSQL(); got != want {
+		t.Errorf("createSQL =\n%s\nwant\n%s", got, want)
+	}
+	if n := len(r.DDL()); n != 6 {
+		t.Errorf("DDL has %d statements, want 6", n)
+	}
+}
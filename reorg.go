@@ -0,0 +1,222 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Reorg handling for low latency mode.
+//
+// Every block of the last reorgMaxDepth is recorded in the blocks table,
+// see blocks.go. Every recorded range is verified to link to the
+// previously recorded block, and the headers of logs to match their block
+// hashes, so the recorded blocks always form a chain. Before each sync the
+// recorded tip is compared to the canonical chain; on mismatch we walk back
+// to the common ancestor and delete everything above it.
+
+// linkHeaders adds the headers of blocks in [fromBlock, toBlock] that are
+// within reorgMaxDepth of maxBlock to headers. It returns false if they do
+// not link to the recorded chain.
+func (s *uniswapSync) linkHeaders(tx dbQuerier, fromBlock, toBlock, maxBlock uint64, headers map[uint64]*blockHeader) (bool, error) {
+	first := fromBlock
+	if maxBlock >= reorgMaxDepth && first <= maxBlock-reorgMaxDepth {
+		first = maxBlock - reorgMaxDepth + 1
+	}
+	if first > toBlock {
+		return true, nil
+	}
+
+	stored, err := dbQueryBlockHashes(s.dbCtx, tx)
+	if err != nil {
+		return false, err
+	}
+	prevHash := ""
+	prev, linked := stored[first-1]
+	if linked {
+		prevHash = prev.hash
+	}
+
+	missing := []uint64{}
+	for n := first; n <= toBlock; n++ {
+		if _, ok := headers[n]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	fetched, err := getHeaders(s.dbCtx, s.rc, missing)
+	if err != nil {
+		return false, err
+	}
+	for n, h := range fetched {
+		headers[n] = h
+	}
+
+	return linkChain(headers, first, toBlock, prevHash, linked), nil
+}
+
+// linkChain returns false if the headers of blocks [first, last] do not
+// form a chain, or do not link to prevHash if linked is true.
+func linkChain(headers map[uint64]*blockHeader, first, last uint64, prevHash string, linked bool) bool {
+	for n := first; n <= last; n++ {
+		h := headers[n]
+		if linked && h.ParentHash.Hex() != prevHash {
+			log.Warn("reorg while syncing: parent hash mismatch", "block", n, "parent", h.ParentHash.Hex(), "recorded", prevHash)
+			return false
+		}
+		prevHash, linked = h.Hash().Hex(), true
+	}
+	return true
+}
+
+// checkReorg compares the recorded tip to the canonical chain and rolls
+// back to the most recent common ancestor if they diverge. The recorded
+// blocks may have gaps; a reorg deeper than the recorded blocks of the last
+// reorgMaxDepth is an ErrReorg.
+func (s *uniswapSync) checkReorg() error {
+	stored, err := dbQueryBlockHashes(s.dbCtx, s.dbConn)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+
+	var tip uint64
+	low := uint64(math.MaxUint64)
+	for n := range stored {
+		if n > tip {
+			tip = n
+		}
+		if n < low {
+			low = n
+		}
+	}
+
+	hs, err := getHeaders(s.ctx, s.rc, []uint64{tip})
+	if err != nil {
+		return err
+	}
+	if hs[tip].Hash().Hex() == stored[tip].hash {
+		return nil
+	}
+
+	// canonical headers of the recorded window, including missing blocks
+	ns := []uint64{}
+	for n := low; n < tip; n++ {
+		ns = append(ns, n)
+	}
+	canonical, err := getHeaders(s.ctx, s.rc, ns)
+	if err != nil {
+		return err
+	}
+	ancestor, ok := commonAncestor(stored, canonical, low, tip)
+	if !ok {
+		return newError(ErrReorg, "checkReorg", fmt.Errorf("no block of the %d recorded in [%d, %d] is canonical", len(stored), low, tip))
+	}
+	log.Warn("reorg detected", "tip", tip, "ancestor", ancestor, "depth", tip-ancestor)
+	return s.rollback(ancestor)
+}
+
+// commonAncestor returns the highest block in [low, tip) that is canonical
+// and part of the recorded chain: either its recorded hash is canonical, or
+// it is missing and its canonical hash is the recorded parent of the next
+// block.
+func commonAncestor(stored map[uint64]*recordedBlock, canonical map[uint64]*blockHeader, low, tip uint64) (uint64, bool) {
+	for n := tip; n > low; {
+		n--
+		hash := canonical[n].Hash().Hex()
+		if b, ok := stored[n]; ok {
+			if b.hash == hash {
+				return n, true
+			}
+			continue
+		}
+		if child, ok := stored[n+1]; ok && child.parentHash == hash {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// rollback deletes all rows above block ancestor and moves the sync cursor
+// back in one transaction, then reloads the address set.
+func (s *uniswapSync) rollback(ancestor uint64) error {
+	ctx := s.dbCtx
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return dbError("dbConn.Begin", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// candles of the deleted blocks are computed again afterwards
+	t0, t1, err := dbBlockTimes(ctx, tx, ancestor+1, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+
+	tables := []string{"us_factory", "blocks", "transactions", "lp_balances", "lp_supply"}
+	for _, t := range usPairEventTables {
+		tables = append(tables, "us_pair_"+t)
+	}
+	tables = append(tables, s.reg.Tables()...)
+	for _, t := range tables {
+		col := "block"
+		if t == "blocks" {
+			col = "number"
+		}
+		tn, err := dbTable(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM "+tn+" WHERE "+col+" > $1", ancestor)
+		if err != nil {
+			return dbError("tx.Exec", err)
+		}
+	}
+	err = dbRebuildPairState(ctx, tx, ancestor)
+	if err != nil {
+		return err
+	}
+	if t0 != nil {
+		err = dbBuildCandlesTime(ctx, tx, *t0, *t1)
+		if err != nil {
+			return err
+		}
+	}
+	err = dbSetSyncCursor(ctx, tx, syncCursorName, ancestor)
+	if err != nil {
+		return err
+	}
+	// registry contracts
+	err = dbExec(ctx, tx, "UPDATE sync_cursor SET block = $1, updated_at = now() WHERE block > $1", []interface{}{ancestor})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return dbError("tx.Commit", err)
+	}
+
+	log.Info("rolled back", "ancestor", ancestor)
+	return s.loadPairs()
+}
@@ -0,0 +1,232 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// londonHeader is a header as hashed since the London fork.
+type londonHeader struct {
+	ParentHash common.Hash
+	UncleHash common.Hash
+	Coinbase common.Address
+	Root common.Hash
+	TxHash common.Hash
+	ReceiptHash common.Hash
+	Bloom types.Bloom
+	Difficulty *big.Int
+	Number *big.Int
+	GasLimit uint64
+	GasUsed uint64
+	Time uint64
+	Extra []byte
+	MixDigest common.Hash
+	Nonce types.BlockNonce
+	BaseFee *big.Int
+}
+
+// londonHeaderJSON returns the eth_getBlockByNumber result of a block
+// after London and its hash.
+func londonHeaderJSON(t *testing.T, number uint64, parent common.Hash) ([]byte, common.Hash) {
+	h := &londonHeader{
+		ParentHash: parent,
+		UncleHash: types.EmptyUncleHash,
+		Coinbase: common.HexToAddress("0x7777788200b672a42421017f65ede4fc759564c8"),
+		Root: common.HexToHash("0x41cf6e8e60fd087d2b00360dc29e5bfb21959bce1f4c242fd1ad7c4da968eb87"),
+		TxHash: common.HexToHash("0xdfcb68d3a3c41096f4a77569db7956e0a0e19f9d4e4b6d4b1ba0e1f9f0d4aa71"),
+		ReceiptHash: common.HexToHash("0x8a8865cd785e2e9dfce7da83aca010b10b9af2abbd367114b236f149534c821d"),
+		Difficulty: big.NewInt(7742494561645080),
+		Number: new(big.Int).SetUint64(number),
+		GasLimit: 30029122,
+		GasUsed: 30025257,
+		Time: 1628166822 + 13*(number-12965000),
+		Extra: []byte("Hiveon"),
+		MixDigest: common.HexToHash("0x9620b46a81a4795cf4449d48e3270419f58b09293a5421205f88179b563f815a"),
+		Nonce: types.EncodeNonce(0xb223da049adf2216),
+		BaseFee: big.NewInt(1000000000),
+	}
+	enc, err := rlp.EncodeToBytes(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.Keccak256Hash(enc)
+
+	b, err := json.Marshal(&types.Header{
+		ParentHash: h.ParentHash,
+		UncleHash: h.UncleHash,
+		Coinbase: h.Coinbase,
+		Root: h.Root,
+		TxHash: h.TxHash,
+		ReceiptHash: h.ReceiptHash,
+		Bloom: h.Bloom,
+		Difficulty: h.Difficulty,
+		Number: h.Number,
+		GasLimit: h.GasLimit,
+		GasUsed: h.GasUsed,
+		Time: h.Time,
+		Extra: h.Extra,
+		MixDigest: h.MixDigest,
+		Nonce: h.Nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields["hash"] = hash.Hex()
+	fields["baseFeePerGas"] = "0x3b9aca00"
+	b, err = json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, hash
+}
+
+func TestBlockHeaderLondon(t *testing.T) {
+	b, hash := londonHeaderJSON(t, 12965000, common.HexToHash("0x3de6bb3849a138e6ab0b83a3a00dc7433f1e83f7fd488e4bba78f2fe2631a633"))
+	var h *blockHeader
+	err := json.Unmarshal(b, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Hash() != hash {
+		t.Errorf("Hash() = %s, want %s", h.Hash().Hex(), hash.Hex())
+	}
+	if h.Header.Hash() == hash {
+		t.Errorf("types.Header.Hash() matches the London hash, blockHeader is not needed")
+	}
+	if h.Number.Uint64() != 12965000 {
+		t.Errorf("Number = %d, want 12965000", h.Number)
+	}
+
+	err = json.Unmarshal([]byte(`{"number":"0x1"}`), &h)
+	if err == nil {
+		t.Errorf("header without hash decoded")
+	}
+}
+
+func TestLinkChainLondon(t *testing.T) {
+	recorded := common.HexToHash("0x3de6bb3849a138e6ab0b83a3a00dc7433f1e83f7fd488e4bba78f2fe2631a633")
+	headers := make(map[uint64]*blockHeader)
+	parent := recorded
+	for n := uint64(12965000); n < 12965003; n++ {
+		b, hash := londonHeaderJSON(t, n, parent)
+		var h *blockHeader
+		err := json.Unmarshal(b, &h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[n] = h
+		parent = hash
+	}
+
+	tests := []struct {
+		name string
+		prevHash string
+		linked bool
+		want bool
+	}{
+		{"linked", recorded.Hex(), true, true},
+		{"unlinked", "", false, true},
+		{"reorged", common.HexToHash("0x01").Hex(), true, false},
+	}
+	for _, tt := range tests {
+		got := linkChain(headers, 12965000, 12965002, tt.prevHash, tt.linked)
+		if got != tt.want {
+			t.Errorf("%s: linkChain = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a replaced block in the middle breaks the chain
+	b, _ := londonHeaderJSON(t, 12965001, common.HexToHash("0x02"))
+	var h *blockHeader
+	err := json.Unmarshal(b, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers[12965001] = h
+	if linkChain(headers, 12965000, 12965002, recorded.Hex(), true) {
+		t.Errorf("linkChain accepted a broken chain")
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	canonical := make(map[uint64]*blockHeader)
+	for n := uint64(100); n <= 105; n++ {
+		canonical[n] = &blockHeader{Header: &types.Header{Number: new(big.Int).SetUint64(n)}, hash: common.BigToHash(new(big.Int).SetUint64(n))}
+	}
+	hash := func(n uint64) string {
+		return canonical[n].Hash().Hex()
+	}
+	forked := common.HexToHash("0xff").Hex()
+
+	tests := []struct {
+		name string
+		stored map[uint64]*recordedBlock
+		want uint64
+		ok bool
+	}{
+		{"recorded", map[uint64]*recordedBlock{
+			103: {hash(103), hash(102)},
+			104: {forked, hash(103)},
+			105: {forked, forked},
+		}, 103, true},
+		{"gap", map[uint64]*recordedBlock{
+			100: {hash(100), ""},
+			104: {forked, hash(103)},
+			105: {forked, forked},
+		}, 103, true},
+		{"gap below fork", map[uint64]*recordedBlock{
+			100: {hash(100), ""},
+			104: {forked, forked},
+			105: {forked, forked},
+		}, 100, true},
+		{"too deep", map[uint64]*recordedBlock{
+			103: {forked, forked},
+			105: {forked, forked},
+		}, 0, false},
+		{"single", map[uint64]*recordedBlock{
+			105: {forked, forked},
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		low := uint64(105)
+		for n := range tt.stored {
+			if n < low {
+				low = n
+			}
+		}
+		got, ok := commonAncestor(tt.stored, canonical, low, 105)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: commonAncestor = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
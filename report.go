@@ -0,0 +1,299 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jackc/pgtype"
+)
+
+// Impermanent loss and fee report.
+//
+// LPReport walks the LP balance history of a holder in a pair. Every
+// increase of the balance deposits its share of the reserves into a HODL
+// basket and adds the value of that share to the entry value; decreases
+// remove the same fraction from both. Values are in token1 at the spot
+// price of token0 in token1 at each point, scaled by the token decimals.
+//
+// Swap fees stay in the pair and grow sqrt(k) per LP token, while price
+// changes leave it unchanged. The position's sqrt(k) at deposit is kept
+// as its base liquidity; the growth above it is fee income, and the value
+// of the base liquidity against the HODL value is the impermanent loss.
+// Mints of the protocol fee dilute the LP tokens and are thus netted out.
+
+// valuePrec is the precision of the big.Float values of reports.
+const valuePrec = 256
+
+// LPReport is the history of an LP position.
+type LPReport struct {
+	PairID uint64
+	Holder common.Address
+	Points []*LPReportPoint
+	// k after the last Mint or Burn up to the last point, which the pair
+	// keeps as kLast when the protocol fee is on, and the growth of
+	// sqrt(k) since then from swap fees; nil if unknown
+	KLast *big.Int
+	KLastBlock uint64
+	KGrowth *big.Float
+}
+
+// LPReportPoint is the state of an LP position after a block.
+type LPReportPoint struct {
+	Block uint64
+	Balance, TotalSupply *big.Int
+	// price of token0 in token1
+	Price *big.Float
+	// value of the deposited tokens when deposited, less withdrawals
+	EntryValue *big.Float
+	// value of the position's share of the reserves
+	Value *big.Float
+	// value of the deposited tokens had they been held instead
+	HODLValue *big.Float
+	// part of Value earned from swap fees
+	Fees *big.Float
+	// (Value - Fees) / HODLValue - 1, nil without a HODL value
+	IL *big.Float
+}
+
+func newValue() *big.Float {
+	return new(big.Float).SetPrec(valuePrec)
+}
+
+func floatInt(i *big.Int) *big.Float {
+	return newValue().SetInt(i)
+}
+
+// LPReportAt returns the report of holder in pair pairID up to block
+// toBlock or the last synced block, with a point after every balance
+// change and every step blocks if step is not 0.
+func LPReportAt(ctx context.Context, cfg *Config, pairID uint64, holder common.Address, toBlock, step uint64) (*LPReport, error) {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return dbLPReport(ctx, dbPool, pairID, holder, toBlock, step)
+}
+
+func dbLPReport(ctx context.Context, dbConn dbQuerier, pairID uint64, holder common.Address, toBlock, step uint64) (*LPReport, error) {
+	_, d0, d1, err := dbQueryPairInfo(ctx, dbConn, pairID)
+	if err != nil {
+		return nil, err
+	}
+	if d0 == nil || d1 == nil {
+		return nil, fmt.Errorf("decimals of the tokens of pair %d are unknown", pairID)
+	}
+	// no point after the last committed block
+	cursor, ok, err := dbQuerySyncCursor(ctx, dbConn, syncCursorName)
+	if err != nil {
+		return nil, err
+	}
+	if ok && cursor < toBlock {
+		toBlock = cursor
+	}
+	blocks, err := dbQueryBalanceBlocks(ctx, dbConn, pairID, holder, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s never held LP tokens of pair %d", holder.Hex(), pairID)
+	}
+	if step > 0 {
+		blocks = stepBlocks(blocks, toBlock, step)
+	} else if blocks[len(blocks)-1] < toBlock {
+		blocks = append(blocks, toBlock)
+	}
+
+	r := &LPReport{PairID: pairID, Holder: holder}
+	// scale of raw token1 amounts
+	scale1 := floatInt(pow10(*d1))
+	// raw price to scaled price
+	priceScale := newValue().Quo(floatInt(pow10(*d0)), scale1)
+
+	prevBalance := new(big.Int)
+	hodl0, hodl1 := newValue(), newValue()
+	entry, base := newValue(), newValue()
+	for _, b := range blocks {
+		pos, err := dbLPPositionAt(ctx, dbConn, pairID, holder, b)
+		if err != nil {
+			return nil, err
+		}
+		ps, err := dbReservesAt(ctx, dbConn, pairID, b)
+		if err != nil {
+			return nil, err
+		}
+		if ps == nil || ps.Reserve0.Sign() == 0 || pos.TotalSupply.Sign() == 0 {
+			return nil, fmt.Errorf("no reserves of pair %d at block %d", pairID, b)
+		}
+		r0, r1, supply := floatInt(ps.Reserve0), floatInt(ps.Reserve1), floatInt(pos.TotalSupply)
+		// raw token1 per raw token0
+		price := newValue().Quo(r1, r0)
+		// sqrt(k) per LP token
+		sqrtK := newValue().Mul(r0, r1)
+		sqrtK.Sqrt(sqrtK)
+		unitPerLP := newValue().Quo(sqrtK, supply)
+
+		delta := new(big.Int).Sub(pos.Balance, prevBalance)
+		switch delta.Sign() {
+		case 1:
+			d := floatInt(delta)
+			a0 := newValue().Quo(newValue().Mul(d, r0), supply)
+			a1 := newValue().Quo(newValue().Mul(d, r1), supply)
+			hodl0.Add(hodl0, a0)
+			hodl1.Add(hodl1, a1)
+			entry.Add(entry, a1.Add(a1, a0.Mul(a0, price)))
+			base.Add(base, d.Mul(d, unitPerLP))
+		case -1:
+			// fraction of the position kept
+			keep := newValue().Quo(floatInt(pos.Balance), floatInt(prevBalance))
+			hodl0.Mul(hodl0, keep)
+			hodl1.Mul(hodl1, keep)
+			entry.Mul(entry, keep)
+			base.Mul(base, keep)
+		}
+		prevBalance = pos.Balance
+
+		balance := floatInt(pos.Balance)
+		// the share of reserve0 is worth as much as that of reserve1
+		value := newValue().Quo(newValue().Mul(balance, r1), supply)
+		value.Mul(value, big.NewFloat(2))
+		hodlValue := newValue().Add(newValue().Mul(hodl0, price), hodl1)
+		// U units of sqrt(k) are worth 2 U sqrt(price) in token1
+		sqrtPrice := newValue().Sqrt(price)
+		fees := newValue().Sub(newValue().Mul(balance, unitPerLP), base)
+		fees.Mul(fees, sqrtPrice)
+		fees.Mul(fees, big.NewFloat(2))
+
+		p := &LPReportPoint{
+			Block: b,
+			Balance: pos.Balance,
+			TotalSupply: pos.TotalSupply,
+			Price: newValue().Mul(price, priceScale),
+			EntryValue: newValue().Quo(entry, scale1),
+			Value: value.Quo(value, scale1),
+			HODLValue: hodlValue.Quo(hodlValue, scale1),
+			Fees: fees.Quo(fees, scale1),
+		}
+		if p.HODLValue.Sign() > 0 {
+			il := newValue().Sub(p.Value, p.Fees)
+			il.Quo(il, p.HODLValue)
+			p.IL = il.Sub(il, big.NewFloat(1))
+		}
+		r.Points = append(r.Points, p)
+	}
+
+	last := blocks[len(blocks)-1]
+	r.KLast, r.KLastBlock, err = dbQueryKLast(ctx, dbConn, pairID, last)
+	if err != nil {
+		return nil, err
+	}
+	if r.KLast != nil && r.KLast.Sign() > 0 {
+		ps, err := dbReservesAt(ctx, dbConn, pairID, last)
+		if err != nil {
+			return nil, err
+		}
+		k := new(big.Int).Mul(ps.Reserve0, ps.Reserve1)
+		g := newValue().Quo(floatInt(k), floatInt(r.KLast))
+		g.Sqrt(g)
+		r.KGrowth = g.Sub(g, big.NewFloat(1))
+	}
+	return r, nil
+}
+
+// stepBlocks adds every step-th block from the first of blocks up to
+// toBlock to the sorted blocks.
+func stepBlocks(blocks []uint64, toBlock, step uint64) []uint64 {
+	res := []uint64{}
+	i := 0
+	for b := blocks[0]; ; b += step {
+		if b > toBlock {
+			b = toBlock
+		}
+		for i < len(blocks) && blocks[i] < b {
+			res = append(res, blocks[i])
+			i++
+		}
+		if i < len(blocks) && blocks[i] == b {
+			i++
+		}
+		res = append(res, b)
+		if b == toBlock {
+			break
+		}
+	}
+	return res
+}
+
+// dbQueryBalanceBlocks returns the blocks up to toBlock in which the LP
+// balance of holder in pair pairID changed.
+func dbQueryBalanceBlocks(ctx context.Context, dbConn dbQuerier, pairID uint64, holder common.Address, toBlock uint64) ([]uint64, error) {
+	q := "SELECT block FROM lp_balances WHERE pair_id = $1 AND holder = $2 AND block <= $3 ORDER BY block"
+	rows, err := dbConn.Query(ctx, q, pairID, holder.Hex(), toBlock)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	res := []uint64{}
+	for rows.Next() {
+		var b uint64
+		err = rows.Scan(&b)
+		if err != nil {
+			return nil, dbError("rows.Scan", err)
+		}
+		res = append(res, b)
+	}
+	return res, dbRowsErr(rows)
+}
+
+// dbQueryKLast returns k after the last Mint or Burn of pair pairID up to
+// block, from the Sync that precedes it in the same transaction, and its
+// block; nil if there is none or log positions are unknown.
+func dbQueryKLast(ctx context.Context, dbConn dbQuerier, pairID, block uint64) (*big.Int, uint64, error) {
+	q := "SELECT s.reserve0 * s.reserve1, s.block FROM us_pair_sync s " +
+		"JOIN (SELECT block, log_index FROM (" +
+		"SELECT block, log_index FROM us_pair_mint WHERE pair_id = $1 AND block <= $2 " +
+		"UNION ALL " +
+		"SELECT block, log_index FROM us_pair_burn WHERE pair_id = $1 AND block <= $2" +
+		") e ORDER BY block DESC, log_index DESC NULLS LAST LIMIT 1) e " +
+		"ON s.block = e.block AND s.log_index < e.log_index " +
+		"WHERE s.pair_id = $1 " +
+		"ORDER BY s.log_index DESC LIMIT 1"
+	rows, err := dbConn.Query(ctx, q, pairID, block)
+	if err != nil {
+		return nil, 0, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, 0, dbRowsErr(rows)
+	}
+	var k pgtype.Numeric
+	var b uint64
+	err = rows.Scan(&k, &b)
+	if err != nil {
+		return nil, 0, dbError("rows.Scan", err)
+	}
+	return numericInt(k), b, dbRowsErr(rows)
+}
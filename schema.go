@@ -0,0 +1,897 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+// Schema migrations, applied in order by migrate.go.
+// Never edit a migration once it has been released: its checksum is
+// recorded in schema_version and verified on every startup. Add a new
+// migration instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "uniswap v2 factory and pair events",
+		// IF NOT EXISTS so that databases created by hand before
+		// migrations existed are adopted as version 1.
+		up: `
+CREATE TABLE IF NOT EXISTS us_factory (
+	pair      TEXT   NOT NULL,
+	block     BIGINT NOT NULL,
+	tx_hash   TEXT   NOT NULL,
+	token0    TEXT   NOT NULL,
+	token1    TEXT   NOT NULL,
+	pair_addr TEXT   NOT NULL,
+	pair_id   BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_factory_block_idx ON us_factory (block);
+CREATE INDEX IF NOT EXISTS us_factory_pair_idx ON us_factory (pair text_pattern_ops);
+CREATE UNIQUE INDEX IF NOT EXISTS us_factory_pair_addr_idx ON us_factory (pair_addr);
+
+CREATE TABLE IF NOT EXISTS us_pair_mint (
+	pair    TEXT   NOT NULL,
+	block   BIGINT NOT NULL,
+	tx_hash TEXT   NOT NULL,
+	sender  TEXT   NOT NULL,
+	amount0 TEXT   NOT NULL,
+	amount1 TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_mint_pair_block_idx ON us_pair_mint (pair, block);
+
+CREATE TABLE IF NOT EXISTS us_pair_burn (
+	pair    TEXT   NOT NULL,
+	block   BIGINT NOT NULL,
+	tx_hash TEXT   NOT NULL,
+	sender  TEXT   NOT NULL,
+	dest    TEXT   NOT NULL,
+	amount0 TEXT   NOT NULL,
+	amount1 TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_burn_pair_block_idx ON us_pair_burn (pair, block);
+
+CREATE TABLE IF NOT EXISTS us_pair_swap (
+	pair       TEXT   NOT NULL,
+	block      BIGINT NOT NULL,
+	tx_hash    TEXT   NOT NULL,
+	sender     TEXT   NOT NULL,
+	dest       TEXT   NOT NULL,
+	amount0In  TEXT   NOT NULL,
+	amount1In  TEXT   NOT NULL,
+	amount0Out TEXT   NOT NULL,
+	amount1Out TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_swap_pair_block_idx ON us_pair_swap (pair, block);
+
+CREATE TABLE IF NOT EXISTS us_pair_sync (
+	pair     TEXT   NOT NULL,
+	block    BIGINT NOT NULL,
+	tx_hash  TEXT   NOT NULL,
+	reserve0 TEXT   NOT NULL,
+	reserve1 TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_sync_pair_block_idx ON us_pair_sync (pair, block);
+
+CREATE TABLE IF NOT EXISTS us_pair_approval (
+	pair    TEXT   NOT NULL,
+	block   BIGINT NOT NULL,
+	tx_hash TEXT   NOT NULL,
+	owner   TEXT   NOT NULL,
+	spender TEXT   NOT NULL,
+	value   TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_approval_pair_block_idx ON us_pair_approval (pair, block);
+
+CREATE TABLE IF NOT EXISTS us_pair_transfer (
+	pair    TEXT   NOT NULL,
+	block   BIGINT NOT NULL,
+	tx_hash TEXT   NOT NULL,
+	sender  TEXT   NOT NULL,
+	dest    TEXT   NOT NULL,
+	value   TEXT   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS us_pair_transfer_pair_block_idx ON us_pair_transfer (pair, block);
+`,
+		down: `
+DROP TABLE IF EXISTS us_pair_transfer;
+DROP TABLE IF EXISTS us_pair_approval;
+DROP TABLE IF EXISTS us_pair_sync;
+DROP TABLE IF EXISTS us_pair_swap;
+DROP TABLE IF EXISTS us_pair_burn;
+DROP TABLE IF EXISTS us_pair_mint;
+DROP TABLE IF EXISTS us_factory;
+`,
+	},
+	{
+		version: 2,
+		name:    "block hashes for reorg detection",
+		up: `
+CREATE TABLE blocks (
+	number      BIGINT PRIMARY KEY,
+	hash        TEXT   NOT NULL,
+	parent_hash TEXT   NOT NULL
+);
+`,
+		down: `
+DROP TABLE blocks;
+`,
+	},
+	{
+		version: 3,
+		name:    "sync cursor",
+		up: `
+CREATE TABLE sync_cursor (
+	name       TEXT        PRIMARY KEY,
+	block      BIGINT      NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`,
+		down: `
+DROP TABLE sync_cursor;
+`,
+	},
+	{
+		version: 4,
+		name:    "token metadata",
+		up: `
+CREATE TABLE tokens (
+	addr       TEXT        PRIMARY KEY,
+	symbol     TEXT        NOT NULL,
+	name       TEXT        NOT NULL,
+	decimals   SMALLINT,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`,
+		down: `
+DROP TABLE tokens;
+`,
+	},
+	{
+		version: 5,
+		name:    "token metadata decoding strategy",
+		up: `
+ALTER TABLE tokens
+	ADD COLUMN symbol_source TEXT NOT NULL DEFAULT 'unknown',
+	ADD COLUMN name_source   TEXT NOT NULL DEFAULT 'unknown';
+`,
+		down: `
+ALTER TABLE tokens
+	DROP COLUMN symbol_source,
+	DROP COLUMN name_source;
+`,
+	},
+	{
+		version: 6,
+		name:    "pair ids instead of tickers",
+		// Pair rows are keyed by the allPairs index of the pair (the
+		// uint of PairCreated) instead of the count-suffixed ticker, which
+		// becomes the mutable label of us_factory without the suffix.
+		// Rows of pairs missing from us_factory, left by a crash between
+		// the event and factory inserts, are dropped; the sync writes them
+		// again.
+		up: `
+ALTER TABLE us_pair_mint ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_mint p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_mint WHERE pair_id IS NULL;
+ALTER TABLE us_pair_mint ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_mint DROP COLUMN pair;
+CREATE INDEX us_pair_mint_pair_id_block_idx ON us_pair_mint (pair_id, block);
+
+ALTER TABLE us_pair_burn ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_burn p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_burn WHERE pair_id IS NULL;
+ALTER TABLE us_pair_burn ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_burn DROP COLUMN pair;
+CREATE INDEX us_pair_burn_pair_id_block_idx ON us_pair_burn (pair_id, block);
+
+ALTER TABLE us_pair_swap ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_swap p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_swap WHERE pair_id IS NULL;
+ALTER TABLE us_pair_swap ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_swap DROP COLUMN pair;
+CREATE INDEX us_pair_swap_pair_id_block_idx ON us_pair_swap (pair_id, block);
+
+ALTER TABLE us_pair_sync ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_sync p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_sync WHERE pair_id IS NULL;
+ALTER TABLE us_pair_sync ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_sync DROP COLUMN pair;
+CREATE INDEX us_pair_sync_pair_id_block_idx ON us_pair_sync (pair_id, block);
+
+ALTER TABLE us_pair_approval ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_approval p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_approval WHERE pair_id IS NULL;
+ALTER TABLE us_pair_approval ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_approval DROP COLUMN pair;
+CREATE INDEX us_pair_approval_pair_id_block_idx ON us_pair_approval (pair_id, block);
+
+ALTER TABLE us_pair_transfer ADD COLUMN pair_id BIGINT;
+UPDATE us_pair_transfer p SET pair_id = f.pair_id FROM us_factory f WHERE p.pair = f.pair;
+DELETE FROM us_pair_transfer WHERE pair_id IS NULL;
+ALTER TABLE us_pair_transfer ALTER COLUMN pair_id SET NOT NULL;
+ALTER TABLE us_pair_transfer DROP COLUMN pair;
+CREATE INDEX us_pair_transfer_pair_id_block_idx ON us_pair_transfer (pair_id, block);
+
+ALTER TABLE us_factory RENAME COLUMN pair TO label;
+UPDATE us_factory SET label = regexp_replace(label, '-[0-9]+$', '');
+DROP INDEX IF EXISTS us_factory_pair_idx;
+CREATE INDEX us_factory_label_idx ON us_factory (label);
+CREATE UNIQUE INDEX us_factory_pair_id_idx ON us_factory (pair_id);
+`,
+		down: `
+DROP INDEX us_factory_pair_id_idx;
+DROP INDEX us_factory_label_idx;
+UPDATE us_factory f SET label = f.label || '-' || n.i
+FROM (SELECT pair_id, row_number() OVER (PARTITION BY label ORDER BY pair_id) - 1 AS i FROM us_factory) n
+WHERE f.pair_id = n.pair_id;
+
+ALTER TABLE us_pair_mint ADD COLUMN pair TEXT;
+UPDATE us_pair_mint p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_mint ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_mint DROP COLUMN pair_id;
+CREATE INDEX us_pair_mint_pair_block_idx ON us_pair_mint (pair, block);
+
+ALTER TABLE us_pair_burn ADD COLUMN pair TEXT;
+UPDATE us_pair_burn p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_burn ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_burn DROP COLUMN pair_id;
+CREATE INDEX us_pair_burn_pair_block_idx ON us_pair_burn (pair, block);
+
+ALTER TABLE us_pair_swap ADD COLUMN pair TEXT;
+UPDATE us_pair_swap p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_swap ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_swap DROP COLUMN pair_id;
+CREATE INDEX us_pair_swap_pair_block_idx ON us_pair_swap (pair, block);
+
+ALTER TABLE us_pair_sync ADD COLUMN pair TEXT;
+UPDATE us_pair_sync p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_sync ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_sync DROP COLUMN pair_id;
+CREATE INDEX us_pair_sync_pair_block_idx ON us_pair_sync (pair, block);
+
+ALTER TABLE us_pair_approval ADD COLUMN pair TEXT;
+UPDATE us_pair_approval p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_approval ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_approval DROP COLUMN pair_id;
+CREATE INDEX us_pair_approval_pair_block_idx ON us_pair_approval (pair, block);
+
+ALTER TABLE us_pair_transfer ADD COLUMN pair TEXT;
+UPDATE us_pair_transfer p SET pair = f.label FROM us_factory f WHERE p.pair_id = f.pair_id;
+ALTER TABLE us_pair_transfer ALTER COLUMN pair SET NOT NULL;
+ALTER TABLE us_pair_transfer DROP COLUMN pair_id;
+CREATE INDEX us_pair_transfer_pair_block_idx ON us_pair_transfer (pair, block);
+
+ALTER TABLE us_factory RENAME COLUMN label TO pair;
+CREATE INDEX us_factory_pair_idx ON us_factory (pair text_pattern_ops);
+`,
+	},
+	{
+		version: 7,
+		name:    "numeric amounts",
+		// uint112 and uint256 amounts were stored as decimal TEXT. The
+		// _adj views add the amounts scaled by the token decimals, NULL
+		// for tokens without decimals.
+		up: `
+ALTER TABLE us_pair_mint
+	ALTER COLUMN amount0 TYPE NUMERIC(78,0) USING amount0::NUMERIC(78,0),
+	ALTER COLUMN amount1 TYPE NUMERIC(78,0) USING amount1::NUMERIC(78,0);
+
+ALTER TABLE us_pair_burn
+	ALTER COLUMN amount0 TYPE NUMERIC(78,0) USING amount0::NUMERIC(78,0),
+	ALTER COLUMN amount1 TYPE NUMERIC(78,0) USING amount1::NUMERIC(78,0);
+
+ALTER TABLE us_pair_swap
+	ALTER COLUMN amount0in TYPE NUMERIC(78,0) USING amount0in::NUMERIC(78,0),
+	ALTER COLUMN amount1in TYPE NUMERIC(78,0) USING amount1in::NUMERIC(78,0),
+	ALTER COLUMN amount0out TYPE NUMERIC(78,0) USING amount0out::NUMERIC(78,0),
+	ALTER COLUMN amount1out TYPE NUMERIC(78,0) USING amount1out::NUMERIC(78,0);
+
+ALTER TABLE us_pair_sync
+	ALTER COLUMN reserve0 TYPE NUMERIC(78,0) USING reserve0::NUMERIC(78,0),
+	ALTER COLUMN reserve1 TYPE NUMERIC(78,0) USING reserve1::NUMERIC(78,0);
+
+ALTER TABLE us_pair_approval
+	ALTER COLUMN value TYPE NUMERIC(78,0) USING value::NUMERIC(78,0);
+
+ALTER TABLE us_pair_transfer
+	ALTER COLUMN value TYPE NUMERIC(78,0) USING value::NUMERIC(78,0);
+
+-- amount scaled by 10^-decimals, exact as NUMERIC multiplication is
+CREATE FUNCTION token_amount(amount NUMERIC, decimals SMALLINT) RETURNS NUMERIC
+	LANGUAGE SQL IMMUTABLE STRICT
+	AS $$ SELECT amount * ('1e-' || decimals)::NUMERIC $$;
+
+CREATE VIEW us_pair_mint_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj
+FROM us_pair_mint p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_burn_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj
+FROM us_pair_burn p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_swap_adj AS
+SELECT p.*,
+	token_amount(p.amount0in, t0.decimals) AS amount0in_adj,
+	token_amount(p.amount1in, t1.decimals) AS amount1in_adj,
+	token_amount(p.amount0out, t0.decimals) AS amount0out_adj,
+	token_amount(p.amount1out, t1.decimals) AS amount1out_adj
+FROM us_pair_swap p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_sync_adj AS
+SELECT p.*,
+	token_amount(p.reserve0, t0.decimals) AS reserve0_adj,
+	token_amount(p.reserve1, t1.decimals) AS reserve1_adj
+FROM us_pair_sync p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+-- LP tokens have 18 decimals
+CREATE VIEW us_pair_approval_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj
+FROM us_pair_approval p;
+
+CREATE VIEW us_pair_transfer_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj
+FROM us_pair_transfer p;
+`,
+		down: `
+DROP VIEW us_pair_transfer_adj;
+DROP VIEW us_pair_approval_adj;
+DROP VIEW us_pair_sync_adj;
+DROP VIEW us_pair_swap_adj;
+DROP VIEW us_pair_burn_adj;
+DROP VIEW us_pair_mint_adj;
+DROP FUNCTION token_amount(NUMERIC, SMALLINT);
+
+ALTER TABLE us_pair_mint
+	ALTER COLUMN amount0 TYPE TEXT,
+	ALTER COLUMN amount1 TYPE TEXT;
+
+ALTER TABLE us_pair_burn
+	ALTER COLUMN amount0 TYPE TEXT,
+	ALTER COLUMN amount1 TYPE TEXT;
+
+ALTER TABLE us_pair_swap
+	ALTER COLUMN amount0in TYPE TEXT,
+	ALTER COLUMN amount1in TYPE TEXT,
+	ALTER COLUMN amount0out TYPE TEXT,
+	ALTER COLUMN amount1out TYPE TEXT;
+
+ALTER TABLE us_pair_sync
+	ALTER COLUMN reserve0 TYPE TEXT,
+	ALTER COLUMN reserve1 TYPE TEXT;
+
+ALTER TABLE us_pair_approval
+	ALTER COLUMN value TYPE TEXT;
+
+ALTER TABLE us_pair_transfer
+	ALTER COLUMN value TYPE TEXT;
+`,
+	},
+	{
+		version: 8,
+		name:    "block headers",
+		// blocks keeps the headers of all blocks with events instead of
+		// only the reorg window. Rows recorded before have no header data.
+		up: `
+ALTER TABLE blocks
+	ADD COLUMN time       TIMESTAMPTZ,
+	ADD COLUMN miner      TEXT,
+	ADD COLUMN gas_limit  BIGINT,
+	ADD COLUMN gas_used   BIGINT,
+	ADD COLUMN difficulty NUMERIC(78,0);
+CREATE INDEX blocks_time_idx ON blocks (time);
+
+CREATE OR REPLACE VIEW us_pair_mint_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_mint p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE OR REPLACE VIEW us_pair_burn_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_burn p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE OR REPLACE VIEW us_pair_swap_adj AS
+SELECT p.*,
+	token_amount(p.amount0in, t0.decimals) AS amount0in_adj,
+	token_amount(p.amount1in, t1.decimals) AS amount1in_adj,
+	token_amount(p.amount0out, t0.decimals) AS amount0out_adj,
+	token_amount(p.amount1out, t1.decimals) AS amount1out_adj,
+	b.time AS block_time
+FROM us_pair_swap p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE OR REPLACE VIEW us_pair_sync_adj AS
+SELECT p.*,
+	token_amount(p.reserve0, t0.decimals) AS reserve0_adj,
+	token_amount(p.reserve1, t1.decimals) AS reserve1_adj,
+	b.time AS block_time
+FROM us_pair_sync p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE OR REPLACE VIEW us_pair_approval_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_approval p
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE OR REPLACE VIEW us_pair_transfer_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_transfer p
+LEFT JOIN blocks b ON b.number = p.block;
+`,
+		down: `
+DROP VIEW us_pair_transfer_adj;
+DROP VIEW us_pair_approval_adj;
+DROP VIEW us_pair_sync_adj;
+DROP VIEW us_pair_swap_adj;
+DROP VIEW us_pair_burn_adj;
+DROP VIEW us_pair_mint_adj;
+
+CREATE VIEW us_pair_mint_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj
+FROM us_pair_mint p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_burn_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj
+FROM us_pair_burn p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_swap_adj AS
+SELECT p.*,
+	token_amount(p.amount0in, t0.decimals) AS amount0in_adj,
+	token_amount(p.amount1in, t1.decimals) AS amount1in_adj,
+	token_amount(p.amount0out, t0.decimals) AS amount0out_adj,
+	token_amount(p.amount1out, t1.decimals) AS amount1out_adj
+FROM us_pair_swap p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_sync_adj AS
+SELECT p.*,
+	token_amount(p.reserve0, t0.decimals) AS reserve0_adj,
+	token_amount(p.reserve1, t1.decimals) AS reserve1_adj
+FROM us_pair_sync p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1;
+
+CREATE VIEW us_pair_approval_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj
+FROM us_pair_approval p;
+
+CREATE VIEW us_pair_transfer_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj
+FROM us_pair_transfer p;
+
+DROP INDEX blocks_time_idx;
+ALTER TABLE blocks
+	DROP COLUMN time,
+	DROP COLUMN miner,
+	DROP COLUMN gas_limit,
+	DROP COLUMN gas_used,
+	DROP COLUMN difficulty;
+`,
+	},
+	{
+		version: 9,
+		name:    "log positions",
+		// Rows ingested before have no log position and are not
+		// deduplicated. The _adj views are recreated to include the new
+		// columns.
+		up: `
+DROP VIEW us_pair_transfer_adj;
+DROP VIEW us_pair_approval_adj;
+DROP VIEW us_pair_sync_adj;
+DROP VIEW us_pair_swap_adj;
+DROP VIEW us_pair_burn_adj;
+DROP VIEW us_pair_mint_adj;
+
+ALTER TABLE us_factory
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_factory_block_log_index_idx ON us_factory (block, log_index);
+
+ALTER TABLE us_pair_mint
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_mint_block_log_index_idx ON us_pair_mint (block, log_index);
+
+ALTER TABLE us_pair_burn
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_burn_block_log_index_idx ON us_pair_burn (block, log_index);
+
+ALTER TABLE us_pair_swap
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_swap_block_log_index_idx ON us_pair_swap (block, log_index);
+
+ALTER TABLE us_pair_sync
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_sync_block_log_index_idx ON us_pair_sync (block, log_index);
+
+ALTER TABLE us_pair_approval
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_approval_block_log_index_idx ON us_pair_approval (block, log_index);
+
+ALTER TABLE us_pair_transfer
+	ADD COLUMN tx_index   INTEGER,
+	ADD COLUMN log_index  INTEGER,
+	ADD COLUMN block_hash TEXT;
+CREATE UNIQUE INDEX us_pair_transfer_block_log_index_idx ON us_pair_transfer (block, log_index);
+
+CREATE VIEW us_pair_mint_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_mint p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_burn_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_burn p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_swap_adj AS
+SELECT p.*,
+	token_amount(p.amount0in, t0.decimals) AS amount0in_adj,
+	token_amount(p.amount1in, t1.decimals) AS amount1in_adj,
+	token_amount(p.amount0out, t0.decimals) AS amount0out_adj,
+	token_amount(p.amount1out, t1.decimals) AS amount1out_adj,
+	b.time AS block_time
+FROM us_pair_swap p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_sync_adj AS
+SELECT p.*,
+	token_amount(p.reserve0, t0.decimals) AS reserve0_adj,
+	token_amount(p.reserve1, t1.decimals) AS reserve1_adj,
+	b.time AS block_time
+FROM us_pair_sync p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_approval_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_approval p
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_transfer_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_transfer p
+LEFT JOIN blocks b ON b.number = p.block;
+`,
+		down: `
+DROP VIEW us_pair_transfer_adj;
+DROP VIEW us_pair_approval_adj;
+DROP VIEW us_pair_sync_adj;
+DROP VIEW us_pair_swap_adj;
+DROP VIEW us_pair_burn_adj;
+DROP VIEW us_pair_mint_adj;
+
+DROP INDEX us_factory_block_log_index_idx;
+ALTER TABLE us_factory
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_mint_block_log_index_idx;
+ALTER TABLE us_pair_mint
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_burn_block_log_index_idx;
+ALTER TABLE us_pair_burn
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_swap_block_log_index_idx;
+ALTER TABLE us_pair_swap
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_sync_block_log_index_idx;
+ALTER TABLE us_pair_sync
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_approval_block_log_index_idx;
+ALTER TABLE us_pair_approval
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+DROP INDEX us_pair_transfer_block_log_index_idx;
+ALTER TABLE us_pair_transfer
+	DROP COLUMN tx_index,
+	DROP COLUMN log_index,
+	DROP COLUMN block_hash;
+
+CREATE VIEW us_pair_mint_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_mint p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_burn_adj AS
+SELECT p.*,
+	token_amount(p.amount0, t0.decimals) AS amount0_adj,
+	token_amount(p.amount1, t1.decimals) AS amount1_adj,
+	b.time AS block_time
+FROM us_pair_burn p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_swap_adj AS
+SELECT p.*,
+	token_amount(p.amount0in, t0.decimals) AS amount0in_adj,
+	token_amount(p.amount1in, t1.decimals) AS amount1in_adj,
+	token_amount(p.amount0out, t0.decimals) AS amount0out_adj,
+	token_amount(p.amount1out, t1.decimals) AS amount1out_adj,
+	b.time AS block_time
+FROM us_pair_swap p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_sync_adj AS
+SELECT p.*,
+	token_amount(p.reserve0, t0.decimals) AS reserve0_adj,
+	token_amount(p.reserve1, t1.decimals) AS reserve1_adj,
+	b.time AS block_time
+FROM us_pair_sync p
+JOIN us_factory f ON f.pair_id = p.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_approval_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_approval p
+LEFT JOIN blocks b ON b.number = p.block;
+
+CREATE VIEW us_pair_transfer_adj AS
+SELECT p.*, token_amount(p.value, 18::SMALLINT) AS value_adj,
+	b.time AS block_time
+FROM us_pair_transfer p
+LEFT JOIN blocks b ON b.number = p.block;
+`,
+	},
+	{
+		version: 10,
+		name:    "transactions",
+		up: `
+CREATE TABLE transactions (
+	hash      TEXT          PRIMARY KEY,
+	block     BIGINT        NOT NULL,
+	tx_index  INTEGER       NOT NULL,
+	sender    TEXT          NOT NULL,
+	dest      TEXT,
+	value     NUMERIC(78,0) NOT NULL,
+	nonce     BIGINT        NOT NULL,
+	gas       BIGINT        NOT NULL,
+	gas_price NUMERIC(78,0) NOT NULL,
+	gas_used  BIGINT        NOT NULL,
+	status    SMALLINT
+);
+CREATE INDEX transactions_block_idx ON transactions (block);
+CREATE INDEX transactions_sender_idx ON transactions (sender);
+
+CREATE VIEW us_pair_swap_tx AS
+SELECT p.*,
+	t.sender AS tx_sender,
+	t.gas_used,
+	t.gas_price,
+	t.gas_used * t.gas_price AS tx_fee,
+	t.status AS tx_status
+FROM us_pair_swap_adj p
+LEFT JOIN transactions t ON t.hash = p.tx_hash;
+`,
+		down: `
+DROP VIEW us_pair_swap_tx;
+DROP TABLE transactions;
+`,
+	},
+	{
+		version: 11,
+		name:    "pair state",
+		up: `
+-- price of base in quote, scaled by the token decimals
+CREATE FUNCTION spot_price(base NUMERIC, base_decimals SMALLINT, quote NUMERIC, quote_decimals SMALLINT) RETURNS NUMERIC
+	LANGUAGE SQL IMMUTABLE STRICT
+	AS $$ SELECT token_amount(quote, quote_decimals) / NULLIF(token_amount(base, base_decimals), 0) $$;
+
+CREATE TABLE pair_state (
+	pair_id    BIGINT        PRIMARY KEY,
+	block      BIGINT        NOT NULL,
+	log_index  INTEGER,
+	reserve0   NUMERIC(78,0) NOT NULL,
+	reserve1   NUMERIC(78,0) NOT NULL,
+	k          NUMERIC       NOT NULL,
+	price0     NUMERIC,
+	price1     NUMERIC,
+	updated_at TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+
+INSERT INTO pair_state (pair_id, block, log_index, reserve0, reserve1, k, price0, price1)
+SELECT DISTINCT ON (s.pair_id) s.pair_id, s.block, s.log_index, s.reserve0, s.reserve1,
+	s.reserve0 * s.reserve1,
+	spot_price(s.reserve0, t0.decimals, s.reserve1, t1.decimals),
+	spot_price(s.reserve1, t1.decimals, s.reserve0, t0.decimals)
+FROM us_pair_sync s
+JOIN us_factory f ON f.pair_id = s.pair_id
+LEFT JOIN tokens t0 ON t0.addr = f.token0
+LEFT JOIN tokens t1 ON t1.addr = f.token1
+ORDER BY s.pair_id, s.block DESC, s.log_index DESC NULLS LAST;
+`,
+		down: `
+DROP TABLE pair_state;
+DROP FUNCTION spot_price(NUMERIC, SMALLINT, NUMERIC, SMALLINT);
+`,
+	},
+	{
+		version: 12,
+		name:    "candles",
+		up: `
+-- start of the period of secs seconds containing t
+CREATE FUNCTION candle_start(t TIMESTAMPTZ, secs INTEGER) RETURNS TIMESTAMPTZ
+	LANGUAGE SQL IMMUTABLE STRICT
+	AS $$ SELECT to_timestamp(floor(extract(epoch FROM t) / secs) * secs) $$;
+
+CREATE TABLE candles (
+	pair_id     BIGINT      NOT NULL,
+	period      TEXT        NOT NULL,
+	start       TIMESTAMPTZ NOT NULL,
+	open        NUMERIC     NOT NULL,
+	high        NUMERIC     NOT NULL,
+	low         NUMERIC     NOT NULL,
+	close       NUMERIC     NOT NULL,
+	volume0     NUMERIC     NOT NULL,
+	volume1     NUMERIC     NOT NULL,
+	trades      INTEGER     NOT NULL,
+	first_block BIGINT      NOT NULL,
+	last_block  BIGINT      NOT NULL,
+	PRIMARY KEY (pair_id, period, start)
+);
+CREATE INDEX candles_period_start_idx ON candles (period, start);
+`,
+		down: `
+DROP TABLE candles;
+DROP FUNCTION candle_start(TIMESTAMPTZ, INTEGER);
+`,
+	},
+	{
+		version: 13,
+		name:    "lp balances",
+		up: `
+CREATE TABLE lp_balances (
+	pair_id BIGINT        NOT NULL,
+	holder  TEXT          NOT NULL,
+	block   BIGINT        NOT NULL,
+	balance NUMERIC(78,0) NOT NULL,
+	PRIMARY KEY (pair_id, holder, block)
+);
+CREATE INDEX lp_balances_holder_idx ON lp_balances (holder, pair_id, block);
+CREATE INDEX lp_balances_block_idx ON lp_balances (block);
+
+CREATE TABLE lp_supply (
+	pair_id      BIGINT        NOT NULL,
+	block        BIGINT        NOT NULL,
+	total_supply NUMERIC(78,0) NOT NULL,
+	PRIMARY KEY (pair_id, block)
+);
+CREATE INDEX lp_supply_block_idx ON lp_supply (block);
+
+-- current LP positions with their share of the current reserves
+CREATE VIEW lp_positions AS
+SELECT b.pair_id, b.holder, b.block, b.balance, s.total_supply,
+	div(b.balance * p.reserve0, NULLIF(s.total_supply, 0)) AS amount0,
+	div(b.balance * p.reserve1, NULLIF(s.total_supply, 0)) AS amount1
+FROM (SELECT DISTINCT ON (pair_id, holder) * FROM lp_balances ORDER BY pair_id, holder, block DESC) b
+JOIN (SELECT DISTINCT ON (pair_id) * FROM lp_supply ORDER BY pair_id, block DESC) s ON s.pair_id = b.pair_id
+JOIN pair_state p ON p.pair_id = b.pair_id
+WHERE b.balance <> 0;
+`,
+		down: `
+DROP VIEW lp_positions;
+DROP TABLE lp_supply;
+DROP TABLE lp_balances;
+`,
+	},
+}
@@ -0,0 +1,171 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// hostileSymbols are token symbols that break SQL built by string
+// concatenation: quotes, comment and statement separators, LIKE wildcards,
+// escapes, bytes PostgreSQL TEXT cannot store and very long strings.
+// Anyone can deploy an ERC-20 returning any of these from symbol().
+var hostileSymbols = []string{
+	"'",
+	"''",
+	"O'Reilly",
+	`"`,
+	`\`,
+	`\'`,
+	"'; DROP TABLE us_factory; --",
+	"' OR '1'='1",
+	"') OR ('1'='1",
+	"/*",
+	"--",
+	";",
+	"%",
+	"_",
+	"%_%",
+	"a%",
+	`\%`,
+	"$1",
+	"$$",
+	"$tag$",
+	"E'\\x27'",
+	"\x00NUL",
+	"SYM\x00\x00\x00",
+	"bad\xff\xfeutf8",
+	"a\n\r\tb",
+	"🦄",
+	"Ünïcödé",
+	"",
+	strings.Repeat("'", 64),
+	strings.Repeat("X", 1024),
+}
+
+// checkSymbol is the symbol of the second token of all pairs created by
+// CheckSQL, it contains a LIKE wildcard itself.
+const checkSymbol = "KANOT_CHECK"
+
+// CheckSQL writes a token, a pair and a Sync row for each of
+// hostileSymbols, through both the per-row INSERT and the COPY path, and
+// verifies that symbols and labels read back exactly, also after
+// relabeling. Every run is rolled back, nothing is left in the database.
+func CheckSQL(ctx context.Context, cfg *Config) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dbConn, err := getDBConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Release()
+
+	for _, fs := range []int{1, cfg.CopyFlushSize} {
+		tx, err := dbConn.Begin(ctx)
+		if err != nil {
+			return dbError("dbConn.Begin", err)
+		}
+		err = checkSymbols(ctx, newDBWriter(ctx, tx, fs))
+		tx.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		log.Info("checksql OK", "flushSize", fs, "symbols", len(hostileSymbols))
+	}
+	return nil
+}
+
+func checkSymbols(ctx context.Context, w *dbWriter) error {
+	checkAddr := common.BigToAddress(big.NewInt(1))
+	err := dbUpsertToken(ctx, w, &Token{Addr: checkAddr, Symbol: checkSymbol, Decimals: 18})
+	if err != nil {
+		return err
+	}
+
+	for i, sym := range hostileSymbols {
+		sym = cleanSymbol(sym)
+		n := uint64(i + 2)
+		block := uint64(uniswapFactoryCreateBlock) + n
+		addr := common.BigToAddress(new(big.Int).SetUint64(n))
+
+		err := dbUpsertToken(ctx, w, &Token{Addr: addr, Symbol: sym, Name: sym, Decimals: unknownDecimals})
+		if err != nil {
+			return err
+		}
+		t, err := dbQueryToken(ctx, w, addr)
+		if err != nil {
+			return err
+		}
+		if t == nil || t.Symbol != sym || t.Name != sym || t.Decimals != unknownDecimals {
+			return fmt.Errorf("symbol %q: token read back %+v", sym, t)
+		}
+
+		// label as written by GlueUSV2Factory.Insert, the pair address
+		// doubles as token address
+		label := sym + "-" + checkSymbol
+		err = w.insert("us_factory",
+			[]string{"label", "block", "tx_hash", "token0", "token1", "pair_addr", "pair_id"},
+			[]interface{}{"", block, common.Hash{}.Hex(), addr.Hex(), checkAddr.Hex(), addr.Hex(), n})
+		if err != nil {
+			return err
+		}
+		err = w.insert("us_pair_sync",
+			[]string{"pair_id", "block", "tx_hash", "reserve0", "reserve1"},
+			[]interface{}{n, block, common.Hash{}.Hex(), dbNumeric(big.NewInt(1)), dbNumeric(big.NewInt(1))})
+		if err != nil {
+			return err
+		}
+
+		// dbRelabelPairs only touches pairs whose label changed
+		_, err = dbRelabelPairs(ctx, w)
+		if err != nil {
+			return err
+		}
+		q := "SELECT label FROM us_factory WHERE pair_id = $1"
+		labels, err := dbQueryPairLabels(ctx, w, q, []interface{}{n})
+		if err != nil {
+			return err
+		}
+		if len(labels) != 1 || labels[0] != label {
+			return fmt.Errorf("symbol %q: label read back %q, want %q", sym, labels, label)
+		}
+
+		p, err := NewGlueUSV2Pair(addr, block, n)
+		if err != nil {
+			return err
+		}
+		last, err := p.LastInsertedBlock(ctx, w)
+		if err != nil {
+			return err
+		}
+		if last != block {
+			return fmt.Errorf("symbol %q: last inserted block %d, want %d", sym, last, block)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// testDBConfig returns the config of the test database given by
+// KANOT_TEST_DB, and skips tb if it is not set. The database must be
+// migrated; tests roll back what they write.
+func testDBConfig(tb testing.TB) *Config {
+	dsn := os.Getenv("KANOT_TEST_DB")
+	if dsn == "" {
+		tb.Skip("KANOT_TEST_DB not set")
+	}
+	cfg := DefaultConfig
+	cfg.DBConnString = dsn
+	return &cfg
+}
+
+func TestCleanSymbolHostile(t *testing.T) {
+	for _, sym := range hostileSymbols {
+		got := cleanSymbol(sym)
+		if !utf8.ValidString(got) {
+			t.Errorf("cleanSymbol(%q) = %q, invalid UTF-8", sym, got)
+		}
+		if strings.IndexFunc(got, unicode.IsControl) >= 0 {
+			t.Errorf("cleanSymbol(%q) = %q, contains control characters", sym, got)
+		}
+		if got != strings.TrimSpace(got) {
+			t.Errorf("cleanSymbol(%q) = %q, not trimmed", sym, got)
+		}
+		if cleanSymbol(got) != got {
+			t.Errorf("cleanSymbol(%q) = %q, not idempotent", sym, got)
+		}
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"'", "'"},
+		{"O'Reilly", "O'Reilly"},
+		{"'; DROP TABLE us_factory; --", "'; DROP TABLE us_factory; --"},
+		{"%_%", "%_%"},
+		{"\x00NUL", "NUL"},
+		{"SYM\x00\x00\x00", "SYM"},
+		{"bad\xff\xfeutf8", "badutf8"},
+		{"a\n\r\tb", "ab"},
+		{" UNI ", "UNI"},
+		{"🦄", "🦄"},
+	}
+	for _, tt := range tests {
+		got := cleanSymbol(tt.in)
+		if got != tt.want {
+			t.Errorf("cleanSymbol(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInsertSQLHostile(t *testing.T) {
+	// symbols are only ever passed as parameters: the statement does not
+	// depend on them
+	want := `INSERT INTO "tokens" ("addr", "symbol", "name", "decimals") VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	got, err := insertSQL("tokens", []string{"addr", "symbol", "name", "decimals"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("insertSQL = %s, want %s", got, want)
+	}
+
+	// registry columns are named after ABI arguments, which are as
+	// hostile as symbols
+	for _, sym := range hostileSymbols {
+		q, err := insertSQL("us_factory", []string{sym})
+		if err != nil {
+			t.Fatal(err)
+		}
+		col := strings.TrimSuffix(strings.TrimPrefix(q, `INSERT INTO "us_factory" (`), `) VALUES ($1) ON CONFLICT DO NOTHING`)
+		if len(col) < 2 || col[0] != '"' || col[len(col)-1] != '"' {
+			t.Errorf("column %q: not quoted in %s", sym, q)
+			continue
+		}
+		inner := col[1 : len(col)-1]
+		if strings.Contains(strings.Replace(inner, `""`, "", -1), `"`) {
+			t.Errorf("column %q: unescaped quote in %s", sym, q)
+		}
+		if strings.Contains(inner, "\x00") {
+			t.Errorf("column %q: NUL in %s", sym, q)
+		}
+	}
+}
+
+func TestDBTableWhitelist(t *testing.T) {
+	for _, table := range []string{"us_factory", "tokens", "us_pair_swap", "lp_supply"} {
+		got, err := dbTable(table)
+		if err != nil {
+			t.Errorf("dbTable(%q): %v", table, err)
+		} else if got != `"`+table+`"` {
+			t.Errorf("dbTable(%q) = %s", table, got)
+		}
+	}
+
+	rejected := []string{
+		"",
+		"US_FACTORY",
+		`"us_factory"`,
+		"us_factory; DROP TABLE tokens; --",
+		"us_factory --",
+		"public.us_factory",
+		"pg_user",
+		"schema_migrations_x",
+		"us_pair_unknown",
+	}
+	rejected = append(rejected, hostileSymbols...)
+	for _, table := range rejected {
+		_, err := dbTable(table)
+		if err == nil {
+			t.Errorf("dbTable(%q) accepted", table)
+		}
+		_, err = insertSQL(table, []string{"block"})
+		if err == nil {
+			t.Errorf("insertSQL(%q) accepted", table)
+		}
+	}
+
+	for _, table := range []string{"us_factory", "blocks", "Mixed", "a;b", "a b", strings.Repeat("a", 49)} {
+		err := addDBTable(table)
+		if err == nil {
+			t.Errorf("addDBTable(%q) accepted", table)
+		}
+	}
+}
+
+// TestCheckSQL runs CheckSQL against the database given by KANOT_TEST_DB.
+func TestCheckSQL(t *testing.T) {
+	cfg := testDBConfig(t)
+	err := CheckSQL(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,372 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kanot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"gopkg.in/yaml.v2"
+)
+
+// decimals of tokens without a decimals() function, stored as NULL
+const unknownDecimals = -1
+
+// Strategies by which a symbol or name was decoded, recorded in the
+// tokens table so that odd tickers can be audited.
+const (
+	// ABI encoded string, the ERC-20 standard
+	sourceString = "string"
+	// bytes32 padded with NULs (DSToken, MKR et al)
+	sourceBytes32 = "bytes32"
+	// return data that is neither, read as text
+	sourceRaw = "raw"
+	// token override file
+	sourceOverride = "override"
+	// no usable return data, symbol derived from the address
+	sourceAddress = "address"
+	// no usable return data
+	sourceNone = "none"
+)
+
+// function selectors of the ERC-20 metadata functions
+var (
+	selectorSymbol = common.Hex2Bytes("95d89b41")
+	selectorName = common.Hex2Bytes("06fdde03")
+	selectorDecimals = common.Hex2Bytes("313ce567")
+)
+
+// Token is the ERC-20 metadata of a token contract.
+type Token struct {
+	Addr common.Address
+	Symbol string
+	Name string
+	// unknownDecimals if the token has no decimals()
+	Decimals int16
+
+	// how Symbol and Name were decoded, one of the source* constants
+	SymbolSource string
+	NameSource string
+}
+
+// TokenOverride replaces the metadata read from a token contract. Empty
+// fields are not overridden.
+type TokenOverride struct {
+	Symbol string `yaml:"symbol"`
+	Name string `yaml:"name"`
+	Decimals *int16 `yaml:"decimals"`
+}
+
+// defaultTokenOverrides are tokens known to return unusable metadata.
+var defaultTokenOverrides = map[common.Address]TokenOverride{
+	// fucking digix
+	common.HexToAddress("0xE0B7927c4aF23765Cb51314A0E0521A9645F0E2A"): {Symbol: "DGD"},
+}
+
+// LoadTokenOverrides reads a YAML file mapping token addresses to
+// TokenOverrides on top of the built-in overrides.
+func LoadTokenOverrides(path string) (map[common.Address]TokenOverride, error) {
+	res := make(map[common.Address]TokenOverride)
+	for a, o := range defaultTokenOverrides {
+		res[a] = o
+	}
+	if path == "" {
+		return res, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]TokenOverride)
+	err = yaml.UnmarshalStrict(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for a, o := range m {
+		if !common.IsHexAddress(a) {
+			return nil, fmt.Errorf("%s: invalid token address %q", path, a)
+		}
+		res[common.HexToAddress(a)] = o
+	}
+	return res, nil
+}
+
+// TokenRegistry resolves token metadata once per address over RPC and
+// caches it in memory and in the tokens table.
+//
+// Metadata does not depend on the block it was read at, so it is written
+// with its own statement on dbPool rather than in the sync transaction,
+// and kept on rollbacks.
+type TokenRegistry struct {
+	overrides map[common.Address]TokenOverride
+
+	mu sync.Mutex
+	tokens map[common.Address]*Token
+}
+
+func NewTokenRegistry(overrides map[common.Address]TokenOverride) *TokenRegistry {
+	return &TokenRegistry{
+		overrides: overrides,
+		tokens: make(map[common.Address]*Token),
+	}
+}
+
+// Get returns the metadata of the token at addr, looking it up in memory,
+// then in the tokens table and finally over RPC. Overrides are applied
+// and written back on the first lookup of an address. dbPool must be
+// open, as it is during SyncETH and RelabelPairs.
+func (r *TokenRegistry) Get(ctx context.Context, ec *ethclient.Client, addr common.Address) (*Token, error) {
+	r.mu.Lock()
+	t, ok := r.tokens[addr]
+	r.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	t, err := dbQueryToken(ctx, dbPool, addr)
+	if err != nil {
+		return nil, err
+	}
+	dirty := false
+	if t == nil {
+		t, err = resolveToken(ctx, ec, addr)
+		if err != nil {
+			return nil, err
+		}
+		dirty = true
+	}
+	if o, ok := r.overrides[addr]; ok && o.apply(t) {
+		dirty = true
+	}
+	if dirty {
+		err = dbUpsertToken(ctx, dbPool, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	r.tokens[addr] = t
+	r.mu.Unlock()
+	return t, nil
+}
+
+// apply sets the overridden fields of t and reports whether t changed.
+func (o TokenOverride) apply(t *Token) bool {
+	changed := false
+	if o.Symbol != "" && (o.Symbol != t.Symbol || t.SymbolSource != sourceOverride) {
+		t.Symbol, t.SymbolSource = o.Symbol, sourceOverride
+		changed = true
+	}
+	if o.Name != "" && (o.Name != t.Name || t.NameSource != sourceOverride) {
+		t.Name, t.NameSource = o.Name, sourceOverride
+		changed = true
+	}
+	if o.Decimals != nil && *o.Decimals != t.Decimals {
+		t.Decimals = *o.Decimals
+		changed = true
+	}
+	return changed
+}
+
+// resolveToken calls symbol(), name() and decimals() of the token at addr
+// and decodes whatever they return, see decodeTokenString.
+func resolveToken(ctx context.Context, ec *ethclient.Client, addr common.Address) (*Token, error) {
+	t := &Token{Addr: addr, Decimals: unknownDecimals}
+
+	b, err := callToken(ctx, ec, addr, selectorSymbol)
+	if err != nil {
+		return nil, err
+	}
+	t.Symbol, t.SymbolSource = tokenSymbol(addr, b)
+	if t.SymbolSource == sourceAddress {
+		log.Warn("no token symbol", "addr", addr.Hex(), "ret", common.Bytes2Hex(b))
+	}
+
+	b, err = callToken(ctx, ec, addr, selectorName)
+	if err != nil {
+		return nil, err
+	}
+	t.Name, t.NameSource = decodeTokenString(b)
+
+	b, err = callToken(ctx, ec, addr, selectorDecimals)
+	if err != nil {
+		return nil, err
+	}
+	// uint8 in the standard, uint256 in DSToken
+	if len(b) >= 32 {
+		d := new(big.Int).SetBytes(b[:32])
+		if d.IsUint64() && d.Uint64() <= 255 {
+			t.Decimals = int16(d.Uint64())
+		}
+	}
+
+	return t, nil
+}
+
+// callToken calls the function with the given selector and no arguments
+// at addr. A call that fails in the EVM (revert, invalid opcode) returns no
+// data; any other failure, like a rate limit or a node error, is an
+// ErrRPC, so that the token is resolved again on retry.
+func callToken(ctx context.Context, ec *ethclient.Client, addr common.Address, selector []byte) ([]byte, error) {
+	b, err := ec.CallContract(ctx, ethereum.CallMsg{To: &addr, Data: selector}, nil)
+	if err != nil {
+		if ctx.Err() == nil && isRevertErr(err) {
+			log.Debug("token call failed", "err", err, "addr", addr.Hex(), "selector", common.Bytes2Hex(selector))
+			return nil, nil
+		}
+		return nil, rpcError("ethclient.CallContract", err)
+	}
+	return b, nil
+}
+
+// revertCode is the JSON-RPC error code of a reverted call with revert
+// data, other EVM failures come as -32000 with one of revertMsgs.
+const revertCode = 3
+
+var revertMsgs = []string{
+	"execution reverted",
+	"invalid opcode",
+	"invalid jump destination",
+}
+
+// isRevertErr reports whether err is the node's response to a call that
+// failed in the EVM, and thus fails the same way every time.
+func isRevertErr(err error) bool {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	if rpcErr.ErrorCode() == revertCode {
+		return true
+	}
+	msg := strings.ToLower(rpcErr.Error())
+	for _, m := range revertMsgs {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSymbol decodes the return data of symbol() of the token at addr,
+// see decodeTokenString, and falls back to the start of the address.
+func tokenSymbol(addr common.Address, b []byte) (string, string) {
+	s, source := decodeTokenString(b)
+	if s == "" {
+		// 6 hex digits of the address, without 0x
+		return addr.Hex()[2:8], sourceAddress
+	}
+	return s, source
+}
+
+// decodeTokenString decodes the return data of symbol() or name(), trying
+// in order an ABI encoded string, a bytes32 and the raw return data as
+// text. It returns the decoded string and the strategy that succeeded, or
+// "" and sourceNone.
+func decodeTokenString(b []byte) (string, string) {
+	if s, ok := decodeABIString(b); ok {
+		if s = cleanSymbol(s); s != "" {
+			return s, sourceString
+		}
+	}
+	if len(b) == 32 {
+		if s := cleanSymbol(string(b)); s != "" {
+			return s, sourceBytes32
+		}
+	}
+	if s := cleanSymbol(string(b)); s != "" {
+		return s, sourceRaw
+	}
+	return "", sourceNone
+}
+
+// decodeABIString decodes b as a single ABI encoded dynamic string: an
+// offset word, a length word at the offset, and the padded bytes.
+func decodeABIString(b []byte) (string, bool) {
+	if len(b) < 64 {
+		return "", false
+	}
+	off := new(big.Int).SetBytes(b[:32])
+	if !off.IsUint64() || off.Uint64() > uint64(len(b)-32) {
+		return "", false
+	}
+	o := off.Uint64()
+	n := new(big.Int).SetBytes(b[o : o+32])
+	if !n.IsUint64() || n.Uint64() > uint64(len(b))-o-32 {
+		return "", false
+	}
+	return string(b[o+32 : o+32+n.Uint64()]), true
+}
+
+func dbQueryToken(ctx context.Context, dbConn dbQuerier, addr common.Address) (*Token, error) {
+	q := "SELECT symbol, name, COALESCE(decimals, $2), symbol_source, name_source FROM tokens WHERE addr = $1"
+	rows, err := dbConn.Query(ctx, q, addr.Hex(), int16(unknownDecimals))
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	var t *Token
+	for rows.Next() {
+		t = &Token{Addr: addr}
+		err := rows.Scan(&t.Symbol, &t.Name, &t.Decimals, &t.SymbolSource, &t.NameSource)
+		if err != nil {
+			return nil, dbError("rows.Scan", err)
+		}
+	}
+	return t, dbRowsErr(rows)
+}
+
+func dbUpsertToken(ctx context.Context, dbConn dbQuerier, t *Token) error {
+	q := "INSERT INTO tokens (addr, symbol, name, decimals, symbol_source, name_source) " +
+		"VALUES ($1, $2, $3, NULLIF($4, $5), $6, $7) " +
+		"ON CONFLICT (addr) DO UPDATE SET symbol = EXCLUDED.symbol, name = EXCLUDED.name, " +
+		"decimals = EXCLUDED.decimals, symbol_source = EXCLUDED.symbol_source, " +
+		"name_source = EXCLUDED.name_source, updated_at = now()"
+	args := []interface{}{t.Addr.Hex(), t.Symbol, t.Name, t.Decimals, int16(unknownDecimals), t.SymbolSource, t.NameSource}
+	return dbExec(ctx, dbConn, q, args)
+}
+
+// cleanSymbol removes what PostgreSQL TEXT cannot store and what does not
+// belong in a ticker from an on-chain string: invalid UTF-8, NUL padding
+// and other control characters, surrounding white space.
+func cleanSymbol(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
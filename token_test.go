@@ -0,0 +1,134 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func packString(t *testing.T, s string) []byte {
+	typ, err := abi.NewType("string", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := abi.Arguments{{Type: typ}}.Pack(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func bytes32(s string) []byte {
+	b := make([]byte, 32)
+	copy(b, s)
+	return b
+}
+
+func TestTokenSymbol(t *testing.T) {
+	addr := common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+
+	// ABI string whose offset points past the data
+	badOffset := packString(t, "UNI")
+	badOffset[31] = 0xff
+
+	tests := []struct {
+		name string
+		ret []byte
+		want string
+		source string
+	}{
+		{"string", packString(t, "UNI"), "UNI", sourceString},
+		{"string with NUL padding", packString(t, "WETH\x00\x00"), "WETH", sourceString},
+		{"string with spaces", packString(t, " DAI \n"), "DAI", sourceString},
+		{"string with invalid UTF-8", packString(t, "US\xffDC"), "USDC", sourceString},
+		{"unicode string", packString(t, "🦄"), "🦄", sourceString},
+		// DGD, MKR and SAI return bytes32
+		{"bytes32", bytes32("DGD"), "DGD", sourceBytes32},
+		{"bytes32 full", bytes32("ABCDEFGHIJKLMNOPQRSTUVWXYZ012345"), "ABCDEFGHIJKLMNOPQRSTUVWXYZ012345", sourceBytes32},
+		{"raw", []byte("XYZ"), "XYZ", sourceRaw},
+		{"raw with bad ABI offset", badOffset, "UNI", sourceRaw},
+		{"empty string", packString(t, ""), "5aAeb6", sourceAddress},
+		{"empty bytes32", make([]byte, 32), "5aAeb6", sourceAddress},
+		{"no return data", nil, "5aAeb6", sourceAddress},
+		{"garbage", bytes.Repeat([]byte{0xff, 0x00}, 32), "5aAeb6", sourceAddress},
+	}
+	for _, tt := range tests {
+		got, source := tokenSymbol(addr, tt.ret)
+		if got != tt.want || source != tt.source {
+			t.Errorf("%s: tokenSymbol = %q, %s, want %q, %s", tt.name, got, source, tt.want, tt.source)
+		}
+	}
+}
+
+func TestDecodeABIString(t *testing.T) {
+	s, ok := decodeABIString(packString(t, "Maker"))
+	if !ok || s != "Maker" {
+		t.Errorf("decodeABIString = %q, %v, want Maker", s, ok)
+	}
+
+	// length larger than the data
+	b := packString(t, "Maker")
+	b[63] = 0xff
+	if _, ok := decodeABIString(b); ok {
+		t.Errorf("decodeABIString accepted a length past the data")
+	}
+	// offset of 2^64
+	b = packString(t, "Maker")
+	b[23] = 1
+	if _, ok := decodeABIString(b); ok {
+		t.Errorf("decodeABIString accepted an offset of 2^64")
+	}
+	if _, ok := decodeABIString(bytes32("MKR")); ok {
+		t.Errorf("decodeABIString accepted bytes32")
+	}
+}
+
+func TestIsRevertErr(t *testing.T) {
+	tests := []struct {
+		err error
+		want bool
+	}{
+		{&codeError{3, "execution reverted: not supported"}, true},
+		{&codeError{-32000, "execution reverted"}, true},
+		{&codeError{-32000, "invalid opcode: opcode 0xfe not defined"}, true},
+		{&codeError{-32000, "invalid jump destination"}, true},
+
+		{&codeError{-32005, "daily request count exceeded, request rate limited"}, false},
+		{&codeError{429, "Too Many Requests"}, false},
+		{&codeError{-32000, "header not found"}, false},
+		{&codeError{-32603, "internal error"}, false},
+		{&codeError{-32000, "missing trie node"}, false},
+		// not a response of the node
+		{errors.New("execution reverted"), false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		got := isRevertErr(tt.err)
+		if got != tt.want {
+			t.Errorf("isRevertErr(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Transaction enrichment.
+//
+// Event rows only know the contract that emitted them; with cfg.EnrichTxs
+// the transaction and receipt of every event are fetched and stored in the
+// transactions table, committed with the events, to get the EOA that sent
+// it, its gas cost and whether it succeeded.
+
+// txInfo holds the fields of a transaction and its receipt kept in the
+// transactions table.
+type txInfo struct {
+	hash common.Hash
+	block uint64
+	index uint64
+	sender common.Address
+	// nil for contract creations
+	dest *common.Address
+	value *big.Int
+	nonce uint64
+	gas uint64
+	gasPrice *big.Int
+	gasUsed uint64
+	// nil before Byzantium, when receipts had a state root instead
+	status *uint64
+}
+
+// rpcTx and rpcReceipt are the fields of eth_getTransactionByHash and
+// eth_getTransactionReceipt used, types.Transaction does not keep the
+// sender.
+type rpcTx struct {
+	BlockNumber *hexutil.Big `json:"blockNumber"`
+	Index hexutil.Uint64 `json:"transactionIndex"`
+	From common.Address `json:"from"`
+	To *common.Address `json:"to"`
+	Value *hexutil.Big `json:"value"`
+	Nonce hexutil.Uint64 `json:"nonce"`
+	Gas hexutil.Uint64 `json:"gas"`
+	GasPrice *hexutil.Big `json:"gasPrice"`
+}
+
+type rpcReceipt struct {
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Status *hexutil.Uint64 `json:"status"`
+}
+
+// getTransactions fetches the transactions hashes and their receipts in
+// batch requests of txBatchSize.
+func getTransactions(ctx context.Context, rc *rpc.Client, hashes []common.Hash) ([]*txInfo, error) {
+	res := make([]*txInfo, 0, len(hashes))
+	for i := 0; i < len(hashes); i += txBatchSize {
+		hs := hashes[i:]
+		if len(hs) > txBatchSize {
+			hs = hs[:txBatchSize]
+		}
+		txs := make([]*rpcTx, len(hs))
+		rs := make([]*rpcReceipt, len(hs))
+		batch := make([]rpc.BatchElem, 0, 2*len(hs))
+		for j, h := range hs {
+			batch = append(batch,
+				rpc.BatchElem{Method: "eth_getTransactionByHash", Args: []interface{}{h}, Result: &txs[j]},
+				rpc.BatchElem{Method: "eth_getTransactionReceipt", Args: []interface{}{h}, Result: &rs[j]})
+		}
+		err := rc.BatchCallContext(ctx, batch)
+		if err != nil {
+			return nil, rpcError("rpc.BatchCallContext", err)
+		}
+		for _, e := range batch {
+			if e.Error != nil {
+				return nil, rpcError(e.Method, e.Error)
+			}
+		}
+
+		for j, h := range hs {
+			tx, r := txs[j], rs[j]
+			if tx == nil || r == nil || tx.BlockNumber == nil {
+				return nil, rpcError("eth_getTransactionByHash", ethereum.NotFound)
+			}
+			ti := &txInfo{
+				hash: h,
+				block: tx.BlockNumber.ToInt().Uint64(),
+				index: uint64(tx.Index),
+				sender: tx.From,
+				dest: tx.To,
+				value: tx.Value.ToInt(),
+				nonce: uint64(tx.Nonce),
+				gas: uint64(tx.Gas),
+				gasPrice: tx.GasPrice.ToInt(),
+				gasUsed: uint64(r.GasUsed),
+			}
+			if r.Status != nil {
+				st := uint64(*r.Status)
+				ti.status = &st
+			}
+			res = append(res, ti)
+		}
+	}
+	return res, nil
+}
+
+// enrichTxs stores the transactions of logs if enabled in the config.
+func (s *uniswapSync) enrichTxs(tx pgx.Tx, logs []types.Log) error {
+	if !s.cfg.EnrichTxs || len(logs) == 0 {
+		return nil
+	}
+	seen := make(map[common.Hash]bool)
+	hashes := []common.Hash{}
+	for _, l := range logs {
+		if !seen[l.TxHash] {
+			seen[l.TxHash] = true
+			hashes = append(hashes, l.TxHash)
+		}
+	}
+	txs, err := getTransactions(s.dbCtx, s.rc, hashes)
+	if err != nil {
+		return err
+	}
+	return dbUpsertTransactions(s.dbCtx, tx, txs)
+}
+
+// dbUpsertTransactions writes txs to the transactions table in one batch.
+func dbUpsertTransactions(ctx context.Context, tx pgx.Tx, txs []*txInfo) error {
+	q := "INSERT INTO transactions (hash, block, tx_index, sender, dest, value, nonce, gas, gas_price, gas_used, status) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) " +
+		"ON CONFLICT (hash) DO UPDATE SET block = EXCLUDED.block, tx_index = EXCLUDED.tx_index, " +
+		"gas_used = EXCLUDED.gas_used, status = EXCLUDED.status"
+	b := &pgx.Batch{}
+	for _, t := range txs {
+		var dest *string
+		if t.dest != nil {
+			d := t.dest.Hex()
+			dest = &d
+		}
+		b.Queue(q, t.hash.Hex(), t.block, t.index, t.sender.Hex(), dest, dbNumeric(t.value),
+			t.nonce, t.gas, dbNumeric(t.gasPrice), t.gasUsed, t.status)
+	}
+	br := tx.SendBatch(ctx, b)
+	for range txs {
+		_, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return dbError("tx.SendBatch", err)
+		}
+	}
+	err := br.Close()
+	if err != nil {
+		return dbError("tx.SendBatch", err)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+/*  Copyright 2020 The Kano Terminal Authors
+
+    This file is part of kanot.
+
+    kanot is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    kanot is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package kanot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/jackc/pgtype"
+)
+
+// Time-weighted average prices.
+//
+// A Uniswap V2 pair adds price * seconds elapsed to price0CumulativeLast
+// and price1CumulativeLast on the first reserve update of a block, with
+// the reserves before the update and prices as UQ112x112 fixed point
+// numbers (reserve1 << 112 / reserve0 for price0). Oracles read the
+// cumulative prices at two times and divide the difference by the time
+// elapsed; between updates the current cumulative price is extrapolated
+// from the reserves, as in UniswapV2OracleLibrary.currentCumulativePrices.
+//
+// As every reserve update emits a Sync, the same sums are computed from
+// us_pair_sync and the block times: only the last Sync of each block
+// matters, and its reserves are in effect until the next block with a
+// Sync. The results match the on-chain values exactly, which
+// CheckCumulativePrices verifies against an archive node.
+
+var (
+	q112 = new(big.Int).Lsh(big.NewInt(1), 112)
+	// cumulative prices are uint256 and overflow by design
+	uint256Mod = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// CumulativePrices are the price0CumulativeLast and price1CumulativeLast of
+// a pair extrapolated to Time, in unix seconds.
+type CumulativePrices struct {
+	Price0, Price1 *big.Int
+	Time uint64
+}
+
+// PairTWAP is the time-weighted average price of a pair over a period.
+type PairTWAP struct {
+	PairID uint64
+	From, To time.Time
+	// UQ112x112 averages as computed by on-chain oracles
+	Price0X112, Price1X112 *big.Int
+	// price of token0 in token1 and of token1 in token0, scaled by the
+	// token decimals, nil if they are unknown
+	Price0, Price1 *big.Rat
+}
+
+// accumulate adds the prices of reserves r0 and r1 over elapsed seconds to
+// c, as UniswapV2Pair._update does.
+func (c *CumulativePrices) accumulate(r0, r1 *big.Int, elapsed uint64) {
+	if elapsed == 0 || r0.Sign() == 0 || r1.Sign() == 0 {
+		return
+	}
+	e := new(big.Int).SetUint64(elapsed)
+	p0 := new(big.Int).Quo(new(big.Int).Lsh(r1, 112), r0)
+	p1 := new(big.Int).Quo(new(big.Int).Lsh(r0, 112), r1)
+	c.Price0.Add(c.Price0, p0.Mul(p0, e))
+	c.Price1.Add(c.Price1, p1.Mul(p1, e))
+	c.Price0.Mod(c.Price0, uint256Mod)
+	c.Price1.Mod(c.Price1, uint256Mod)
+}
+
+// dbCumulativeDelta returns the increase of the cumulative prices of pair
+// pairID from time from to time to, in unix seconds.
+func dbCumulativeDelta(ctx context.Context, dbConn dbQuerier, pairID, from, to uint64) (*CumulativePrices, error) {
+	c := &CumulativePrices{new(big.Int), new(big.Int), to}
+
+	// reserves in effect at from
+	q := "SELECT s.reserve0, s.reserve1 FROM us_pair_sync s " +
+		"JOIN blocks b ON b.number = s.block " +
+		"WHERE s.pair_id = $1 AND b.time <= to_timestamp($2::BIGINT) " +
+		"ORDER BY s.block DESC, s.log_index DESC NULLS LAST LIMIT 1"
+	rows, err := dbConn.Query(ctx, q, pairID, from)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	r0, r1 := new(big.Int), new(big.Int)
+	for rows.Next() {
+		var n0, n1 pgtype.Numeric
+		err = rows.Scan(&n0, &n1)
+		if err != nil {
+			rows.Close()
+			return nil, dbError("rows.Scan", err)
+		}
+		r0, r1 = numericInt(n0), numericInt(n1)
+	}
+	rows.Close()
+	err = dbRowsErr(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// last Sync of every block in (from, to]
+	q = "SELECT DISTINCT ON (s.block) s.block, extract(epoch FROM b.time)::BIGINT, s.reserve0, s.reserve1 " +
+		"FROM us_pair_sync s " +
+		"LEFT JOIN blocks b ON b.number = s.block " +
+		"WHERE s.pair_id = $1 AND s.block > " +
+		"(SELECT coalesce(max(number), 0) FROM blocks WHERE time <= to_timestamp($2::BIGINT)) " +
+		"AND (b.time IS NULL OR b.time <= to_timestamp($3::BIGINT)) " +
+		"ORDER BY s.block, s.log_index DESC NULLS LAST"
+	rows, err = dbConn.Query(ctx, q, pairID, from, to)
+	if err != nil {
+		return nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	prev := from
+	for rows.Next() {
+		var block uint64
+		var t *int64
+		var n0, n1 pgtype.Numeric
+		err = rows.Scan(&block, &t, &n0, &n1)
+		if err != nil {
+			return nil, dbError("rows.Scan", err)
+		}
+		if t == nil {
+			return nil, fmt.Errorf("no time of block %d, sync its range again to record it", block)
+		}
+		c.accumulate(r0, r1, uint64(*t)-prev)
+		r0, r1, prev = numericInt(n0), numericInt(n1), uint64(*t)
+	}
+	err = dbRowsErr(rows)
+	if err != nil {
+		return nil, err
+	}
+	c.accumulate(r0, r1, to-prev)
+	return c, nil
+}
+
+// TWAP returns the time-weighted average prices of pair pairID from from to
+// to, as an on-chain oracle reading the cumulative prices at both times.
+func TWAP(ctx context.Context, cfg *Config, pairID uint64, from, to time.Time) (*PairTWAP, error) {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return dbTWAP(ctx, dbPool, pairID, from, to)
+}
+
+func dbTWAP(ctx context.Context, dbConn dbQuerier, pairID uint64, from, to time.Time) (*PairTWAP, error) {
+	if !to.After(from) || from.Unix() < 0 {
+		return nil, fmt.Errorf("invalid TWAP period %s to %s", from, to)
+	}
+	c, err := dbCumulativeDelta(ctx, dbConn, pairID, uint64(from.Unix()), uint64(to.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	elapsed := big.NewInt(to.Unix() - from.Unix())
+	tw := &PairTWAP{
+		PairID: pairID,
+		From: from,
+		To: to,
+		Price0X112: new(big.Int).Quo(c.Price0, elapsed),
+		Price1X112: new(big.Int).Quo(c.Price1, elapsed),
+	}
+
+	_, d0, d1, err := dbQueryPairInfo(ctx, dbConn, pairID)
+	if err != nil {
+		return nil, err
+	}
+	if d0 != nil && d1 != nil {
+		tw.Price0 = x112Price(tw.Price0X112, *d0, *d1)
+		tw.Price1 = x112Price(tw.Price1X112, *d1, *d0)
+	}
+	return tw, nil
+}
+
+// x112Price returns a UQ112x112 price of base in quote scaled by their
+// decimals.
+func x112Price(p *big.Int, baseDecimals, quoteDecimals int16) *big.Rat {
+	num := new(big.Int).Mul(p, pow10(baseDecimals))
+	den := new(big.Int).Mul(q112, pow10(quoteDecimals))
+	return new(big.Rat).SetFrac(num, den)
+}
+
+// dbQueryPairInfo returns the address of pair pairID and the decimals of
+// its tokens, nil if unknown.
+func dbQueryPairInfo(ctx context.Context, dbConn dbQuerier, pairID uint64) (common.Address, *int16, *int16, error) {
+	q := "SELECT f.pair_addr, t0.decimals, t1.decimals FROM us_factory f " +
+		"LEFT JOIN tokens t0 ON t0.addr = f.token0 " +
+		"LEFT JOIN tokens t1 ON t1.addr = f.token1 " +
+		"WHERE f.pair_id = $1"
+	rows, err := dbConn.Query(ctx, q, pairID)
+	if err != nil {
+		return common.Address{}, nil, nil, dbError("dbConn.Query", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		err = dbRowsErr(rows)
+		if err == nil {
+			err = fmt.Errorf("no pair %d", pairID)
+		}
+		return common.Address{}, nil, nil, err
+	}
+	var addr string
+	var d0, d1 *int16
+	err = rows.Scan(&addr, &d0, &d1)
+	if err != nil {
+		return common.Address{}, nil, nil, dbError("rows.Scan", err)
+	}
+	return common.HexToAddress(addr), d0, d1, dbRowsErr(rows)
+}
+
+// onChainCumulativePrices reads the cumulative prices of a pair at block
+// from an archive node and extrapolates them to the block time.
+func onChainCumulativePrices(ctx context.Context, ec *ethclient.Client, pair common.Address, block uint64) (*CumulativePrices, error) {
+	p, err := NewUSV2PairCaller(pair, ec)
+	if err != nil {
+		return nil, rpcError("NewUSV2PairCaller", err)
+	}
+	opts := &bind.CallOpts{Context: ctx, BlockNumber: new(big.Int).SetUint64(block)}
+	p0, err := p.Price0CumulativeLast(opts)
+	if err != nil {
+		return nil, rpcError("USV2Pair.Price0CumulativeLast", err)
+	}
+	p1, err := p.Price1CumulativeLast(opts)
+	if err != nil {
+		return nil, rpcError("USV2Pair.Price1CumulativeLast", err)
+	}
+	r, err := p.GetReserves(opts)
+	if err != nil {
+		return nil, rpcError("USV2Pair.GetReserves", err)
+	}
+	h, err := getHeader(ctx, ec, block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CumulativePrices{p0, p1, h.Time}
+	// timestamps are uint32 on chain
+	c.accumulate(r.Reserve0, r.Reserve1, uint64(uint32(h.Time)-r.BlockTimestampLast))
+	return c, nil
+}
+
+// CheckCumulativePrices compares the cumulative prices of pair pairID at
+// block derived from us_pair_sync to those read from an archive node.
+func CheckCumulativePrices(ctx context.Context, cfg *Config, pairID, block uint64) error {
+	release, err := acquireDBPool(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rc, err := getRPCClient(ctx, cfg.Endpoint)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	ec := ethclient.NewClient(rc)
+
+	addr, _, _, err := dbQueryPairInfo(ctx, dbPool, pairID)
+	if err != nil {
+		return err
+	}
+	onChain, err := onChainCumulativePrices(ctx, ec, addr, block)
+	if err != nil {
+		return err
+	}
+	derived, err := dbCumulativeDelta(ctx, dbPool, pairID, 0, onChain.Time)
+	if err != nil {
+		return err
+	}
+
+	log.Info("cumulative prices", "pair", pairID, "block", block, "time", onChain.Time,
+		"price0", onChain.Price0, "price1", onChain.Price1,
+		"derived0", derived.Price0, "derived1", derived.Price1)
+	if onChain.Price0.Cmp(derived.Price0) != 0 || onChain.Price1.Cmp(derived.Price1) != 0 {
+		return fmt.Errorf("cumulative prices of pair %d at block %d do not match", pairID, block)
+	}
+	return nil
+}